@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Identity is the authenticated user behind a socket
+type Identity struct {
+	UserID string
+	Claims map[string]interface{}
+}
+
+// Authenticator authorizes a WebSocket handshake before the connection is
+// hijacked. It returns the identity attached to the resulting socket, or nil
+// for an anonymous connection. Returning an error rejects the upgrade: an
+// *AuthError selects the HTTP status, any other error is answered with 401.
+type Authenticator func(r *http.Request) (*Identity, error)
+
+// AuthError rejects a handshake with an HTTP status
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// OriginChecker reports whether a handshake from a browser Origin is allowed
+type OriginChecker func(r *http.Request) bool
+
+// SetAuthenticator sets the hook that authorizes handshakes. Without one
+// every connection is anonymous.
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.authenticator = auth
+}
+
+// SetAllowedOrigins sets the browser origins allowed to open a socket, in
+// addition to the server's own host. An entry is either an exact origin such
+// as "https://app.example.com" or a wildcard subdomain such as
+// "https://*.example.com"; "*" allows every origin. Entries without a scheme
+// match any scheme.
+func (s *Server) SetAllowedOrigins(origins ...string) {
+	s.allowedOrigins = make([]string, len(origins))
+	for i, origin := range origins {
+		s.allowedOrigins[i] = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	}
+}
+
+// SetOriginChecker sets a custom check for origins that are neither the
+// server's own host nor listed by SetAllowedOrigins
+func (s *Server) SetOriginChecker(check OriginChecker) {
+	s.originChecker = check
+}
+
+// checkOrigin protects against cross-site WebSocket hijacking. Requests
+// without an Origin header come from non-browser clients and are allowed; a
+// browser origin must be the server's own host or be allowed explicitly.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return s.originAllowed(u) || s.originChecker != nil && s.originChecker(r)
+}
+
+// originAllowed matches an origin against the allowed origins
+func (s *Server) originAllowed(u *url.URL) bool {
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	for _, allowed := range s.allowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+		pattern := allowed
+		if i := strings.Index(allowed, "://"); i >= 0 {
+			if allowed[:i] != scheme {
+				continue
+			}
+			pattern = allowed[i+3:]
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate runs the authenticator and answers a rejected handshake
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	if s.authenticator == nil {
+		return nil, true
+	}
+	identity, err := s.authenticator(r)
+	if err == nil {
+		return identity, true
+	}
+
+	status, message := http.StatusUnauthorized, "Unauthorized"
+	if authErr, ok := err.(*AuthError); ok {
+		status = authErr.Status
+		if authErr.Message != "" {
+			message = authErr.Message
+		}
+	}
+	log.Printf("Handshake from %s rejected: %v", r.RemoteAddr, err)
+	http.Error(w, message, status)
+	return nil, false
+}
+
+// BearerToken extracts the token a client presented, from an
+// "Authorization: Bearer" header or, for browsers which cannot set headers
+// on a WebSocket, the "token" query parameter
+func BearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return strings.TrimSpace(header)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// CORS wraps a REST handler with the server's origin policy: allowed
+// origins get Access-Control-Allow-Origin and preflight requests are
+// answered, other cross-origin requests are refused with 403
+func (s *Server) CORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		if !s.checkOrigin(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+package ws
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BackpressurePolicy decides what happens to an outbound message when a
+// socket's send queue is full because the client reads slower than the
+// server writes
+type BackpressurePolicy int32
+
+const (
+	// DropNewest discards the message being sent
+	DropNewest BackpressurePolicy = iota
+	// DropOldest discards the oldest queued message to make room
+	DropOldest
+	// BlockWithTimeout waits up to the block timeout for room in the queue,
+	// then discards the message. Broadcasts wait on all slow sockets at
+	// once rather than one after another.
+	BlockWithTimeout
+	// DisconnectSlow closes the connection with ClosePolicyViolation
+	DisconnectSlow
+)
+
+// DefaultBlockTimeout bounds how long BlockWithTimeout waits for room
+const DefaultBlockTimeout = 100 * time.Millisecond
+
+// String returns the policy name
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case BlockWithTimeout:
+		return "block"
+	case DisconnectSlow:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// backpressure holds the send queue policy and overflow state of a connection
+type backpressure struct {
+	policy       atomic.Int32
+	blockTimeout atomic.Int64
+
+	// dropped counts outbound messages discarded by the policy
+	dropped atomic.Int64
+	// slow is set when the queue overflows and cleared once it drains
+	slow atomic.Bool
+
+	// onSlow is called when the connection becomes slow
+	onSlow func()
+}
+
+// setPolicy sets the overflow policy. A non-positive timeout selects
+// DefaultBlockTimeout.
+func (b *backpressure) setPolicy(policy BackpressurePolicy, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultBlockTimeout
+	}
+	b.policy.Store(int32(policy))
+	b.blockTimeout.Store(int64(timeout))
+}
+
+// enqueue adds a message to the async write queue, applying the backpressure
+// policy when it is full. It reports whether the message was queued.
+func (c *Connection) enqueue(msg outboundMessage) bool {
+	queued := c.push(msg)
+	c.wakeWriter()
+	return queued
+}
+
+// push adds a message to the write queue under the backpressure policy.
+// Without a queue, e.g. on client connections, the message is written
+// synchronously.
+func (c *Connection) push(msg outboundMessage) bool {
+	if c.writeChan == nil {
+		c.writeOutbound(msg)
+		return true
+	}
+	select {
+	case c.writeChan <- msg:
+		return true
+	default:
+	}
+
+	c.markSlow()
+	switch BackpressurePolicy(c.backpressure.policy.Load()) {
+	case DropOldest:
+		for {
+			select {
+			case c.writeChan <- msg:
+				return true
+			default:
+			}
+			select {
+			case <-c.writeChan:
+				c.backpressure.dropped.Add(1)
+			default:
+			}
+		}
+	case BlockWithTimeout:
+		timer := time.NewTimer(time.Duration(c.backpressure.blockTimeout.Load()))
+		defer timer.Stop()
+		select {
+		case c.writeChan <- msg:
+			return true
+		case <-timer.C:
+		case <-c.closeChan:
+		}
+	case DisconnectSlow:
+		c.backpressure.dropped.Add(1)
+		c.writeControlAsync(CloseMessage, formatClosePayload(ClosePolicyViolation, "slow consumer"))
+		return false
+	}
+	c.backpressure.dropped.Add(1)
+	return false
+}
+
+// blocks reports whether sending would wait for room in a full queue under
+// BlockWithTimeout
+func (c *Connection) blocks() bool {
+	return c.writeChan != nil && len(c.writeChan) == cap(c.writeChan) &&
+		BackpressurePolicy(c.backpressure.policy.Load()) == BlockWithTimeout
+}
+
+// markSlow flags the connection as slow, firing the hook on the transition
+func (c *Connection) markSlow() {
+	if c.backpressure.slow.CompareAndSwap(false, true) && c.backpressure.onSlow != nil {
+		c.backpressure.onSlow()
+	}
+}
+
+// clearSlow resets the slow flag once the send queue has drained
+func (c *Connection) clearSlow() {
+	if len(c.writeChan) == 0 {
+		c.backpressure.slow.Store(false)
+	}
+}
+
+// SetBackpressure sets the policy applied when a connection's send queue is
+// full. timeout bounds BlockWithTimeout; 0 selects DefaultBlockTimeout.
+// Applies to connections accepted after the call.
+func (s *Server) SetBackpressure(policy BackpressurePolicy, timeout time.Duration) {
+	s.backpressure = policy
+	s.blockTimeout = timeout
+}
+
+// SetBackpressure overrides the server's backpressure policy for this socket
+func (s *Socket) SetBackpressure(policy BackpressurePolicy, timeout time.Duration) {
+	s.conn.backpressure.setPolicy(policy, timeout)
+}
+
+// Dropped returns the number of outbound messages discarded because the
+// socket's send queue was full
+func (s *Socket) Dropped() int64 {
+	return s.conn.backpressure.dropped.Load()
+}
+
+// IsSlow reports whether the socket's send queue has overflowed and not yet
+// drained
+func (s *Socket) IsSlow() bool {
+	return s.conn.backpressure.slow.Load()
+}
+
+// OnSlow registers a handler called when a socket's send queue overflows.
+// It fires once per episode; the socket is eligible again after its queue
+// drains.
+func (h *Hub) OnSlow(handler Handler) {
+	h.On("slow", handler)
+}
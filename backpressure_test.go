@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+// fullConnection returns a connection whose send queue of size n is full
+func fullConnection(n int, policy BackpressurePolicy, timeout time.Duration) *Connection {
+	c := &Connection{writeChan: make(chan outboundMessage, n), closeChan: make(chan bool)}
+	c.backpressure.setPolicy(policy, timeout)
+	for i := 0; i < n; i++ {
+		c.writeChan <- outboundMessage{messageType: TextMessage, data: []byte{byte(i)}}
+	}
+	return c
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	tests := []struct {
+		policy     BackpressurePolicy
+		wantQueued bool
+		wantFirst  byte
+	}{
+		{DropNewest, false, 0},
+		{DropOldest, true, 9},
+		{BlockWithTimeout, false, 0},
+		{DisconnectSlow, false, 0},
+	}
+	for _, tt := range tests {
+		c := fullConnection(2, tt.policy, time.Millisecond)
+		c.controlChan = make(chan outboundMessage, controlQueueSize)
+		slow := 0
+		c.backpressure.onSlow = func() { slow++ }
+
+		queued := c.push(outboundMessage{messageType: TextMessage, data: []byte{9}})
+		c.push(outboundMessage{messageType: TextMessage, data: []byte{10}})
+		if queued != tt.wantQueued {
+			t.Errorf("%s: queued = %v, want %v", tt.policy, queued, tt.wantQueued)
+		}
+		if got := c.backpressure.dropped.Load(); got != 2 {
+			t.Errorf("%s: dropped = %d, want 2", tt.policy, got)
+		}
+		if slow != 1 {
+			t.Errorf("%s: slow hook fired %d times, want 1", tt.policy, slow)
+		}
+		if first := (<-c.writeChan).data[0]; first != tt.wantFirst {
+			t.Errorf("%s: head of queue = %d, want %d", tt.policy, first, tt.wantFirst)
+		}
+		if tt.policy == DisconnectSlow && len(c.controlChan) == 0 {
+			t.Errorf("%s: no close frame queued", tt.policy)
+		}
+	}
+}
+
+func TestPushWithoutQueueWritesSynchronously(t *testing.T) {
+	client, server := connPair()
+	client.backpressure.setPolicy(BlockWithTimeout, time.Hour)
+
+	done := make(chan bool, 1)
+	go func() { done <- client.push(outboundMessage{messageType: TextMessage, data: []byte("direct")}) }()
+	_, payload, err := server.readMessage()
+	if err != nil || string(payload) != "direct" {
+		t.Fatalf("got %q, %v", payload, err)
+	}
+	if !<-done {
+		t.Fatal("message was not reported as written")
+	}
+}
+
+func TestBroadcastDoesNotHoldHubLock(t *testing.T) {
+	h := NewHub(nil)
+	for i := 0; i < 3; i++ {
+		socket := &Socket{ID: string(rune('a' + i)), hub: h, conn: fullConnection(1, BlockWithTimeout, 200*time.Millisecond)}
+		h.sockets[socket.ID] = socket
+	}
+
+	go h.BroadcastMessage(Message{T: MsgBroadcast, Data: "x"})
+	time.Sleep(20 * time.Millisecond)
+
+	// A broadcast blocked on slow sockets must not keep writers out of the hub
+	locked := make(chan struct{})
+	go func() {
+		h.mu.Lock()
+		h.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("hub lock held while waiting on slow sockets")
+	}
+}
+
+func TestFanOutWaitsOnceForSlowSockets(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name string
+		slow int
+	}{
+		{"one slow socket", 1},
+		{"many slow sockets", 8},
+	}
+	for _, tt := range tests {
+		h := NewHub(nil)
+		fast := testSocket(h)
+		var slow []*Socket
+		for i := 0; i < tt.slow; i++ {
+			socket := &Socket{ID: string(rune('a' + i)), hub: h, conn: fullConnection(1, BlockWithTimeout, timeout)}
+			h.sockets[socket.ID] = socket
+			slow = append(slow, socket)
+		}
+
+		start := time.Now()
+		h.BroadcastMessage(Message{T: MsgBroadcast, Data: "x"})
+		if elapsed := time.Since(start); elapsed < timeout || elapsed > 2*timeout {
+			t.Errorf("%s: broadcast took %v, want one block timeout of %v", tt.name, elapsed, timeout)
+		}
+		for _, socket := range slow {
+			if socket.Dropped() != 1 {
+				t.Errorf("%s: socket %s dropped %d messages, want 1", tt.name, socket.ID, socket.Dropped())
+			}
+		}
+		if got := len(sentMessages(t, fast)); got != 1 {
+			t.Errorf("%s: fast socket got %d messages, want 1", tt.name, got)
+		}
+	}
+}
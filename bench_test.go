@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// loopConn is a net.Conn that endlessly replays one frame to the reader and
+// discards everything written to it
+type loopConn struct {
+	frame []byte
+	pos   int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m := copy(p[n:], c.frame[c.pos:])
+		n += m
+		c.pos = (c.pos + m) % len(c.frame)
+	}
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *loopConn) Close() error                       { return nil }
+func (c *loopConn) LocalAddr() net.Addr                { return nil }
+func (c *loopConn) RemoteAddr() net.Addr               { return nil }
+func (c *loopConn) SetDeadline(t time.Time) error      { return nil }
+func (c *loopConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *loopConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// benchSizes are the payload sizes every frame benchmark runs with
+var benchSizes = []int{64, 1024, 64 * 1024}
+
+// runSizes runs fn as a sub-benchmark for each payload size
+func runSizes(b *testing.B, fn func(b *testing.B, payload []byte)) {
+	for _, size := range benchSizes {
+		payload := bytes.Repeat([]byte("a"), size)
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			fn(b, payload)
+		})
+	}
+}
+
+// serverFrame encodes an unmasked, unfragmented text frame as sent by a
+// server to a client
+func serverFrame(payload []byte) []byte {
+	return rawFrame(finBit, TextMessage, payload, true)
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	runSizes(b, func(b *testing.B, payload []byte) {
+		conn := NewClientConnection(&loopConn{frame: serverFrame(payload)}, nil)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNextReader(b *testing.B) {
+	runSizes(b, func(b *testing.B, payload []byte) {
+		conn := NewClientConnection(&loopConn{frame: serverFrame(payload)}, nil)
+		buf := make([]byte, 4096)
+		for i := 0; i < b.N; i++ {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.CopyBuffer(io.Discard, r, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	runSizes(b, func(b *testing.B, payload []byte) {
+		conn := NewClientConnection(&loopConn{frame: []byte{0}}, nil)
+		for i := 0; i < b.N; i++ {
+			if err := conn.WriteMessage(TextMessage, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNextWriter(b *testing.B) {
+	runSizes(b, func(b *testing.B, payload []byte) {
+		conn := NewClientConnection(&loopConn{frame: []byte{0}}, nil)
+		for i := 0; i < b.N; i++ {
+			w, err := conn.NextWriter(TextMessage)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(payload)
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWritePrepared(b *testing.B) {
+	runSizes(b, func(b *testing.B, payload []byte) {
+		conn := &Connection{conn: &loopConn{frame: []byte{0}}}
+		pm := NewPreparedMessage(TextMessage, payload)
+		for i := 0; i < b.N; i++ {
+			if err := conn.writePrepared(pm); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	runSizes(b, func(b *testing.B, payload []byte) {
+		for i := 0; i < b.N; i++ {
+			maskBytes(key, 0, payload)
+		}
+	})
+}
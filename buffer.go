@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"io"
+	"slices"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer returned to the pool; bigger ones
+// are left to the garbage collector so one large message does not pin
+// memory for the life of the process
+const maxPooledBuffer = 1 << 20
+
+// payloadPool recycles buffers for compressed and fragmented messages and
+// for streamed fragments
+var payloadPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, bufferSize)
+		return &b
+	},
+}
+
+// getPayloadBuffer returns an empty buffer from the pool
+func getPayloadBuffer() *[]byte {
+	return payloadPool.Get().(*[]byte)
+}
+
+// putPayloadBuffer returns a buffer to the pool
+func putPayloadBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	payloadPool.Put(b)
+}
+
+// readAll reads r to EOF through a pooled buffer and returns an exactly sized
+// copy. A positive limit caps the size.
+func readAll(r io.Reader, limit int64) ([]byte, error) {
+	buf := getPayloadBuffer()
+	defer putPayloadBuffer(buf)
+
+	b := *buf
+	for {
+		if len(b) == cap(b) {
+			b = slices.Grow(b, max(len(b), bufferSize))
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if limit > 0 && int64(len(b)) > limit {
+			*buf = b
+			return nil, errMessageTooLarge
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			*buf = b
+			return nil, err
+		}
+	}
+	*buf = b
+	return append([]byte(nil), b...), nil
+}
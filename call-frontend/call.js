@@ -170,7 +170,7 @@ class WebRTCCallClient {
     }
 
     async joinCall() {
-        const authToken = document.getElementById('authToken').value.trim() || 'demo-token';
+        let authToken = document.getElementById('authToken').value.trim();
         const roomId = document.getElementById('roomId').value.trim() || this.generateRoomId();
         const displayName = document.getElementById('displayName').value.trim();
         const audioEnabled = document.getElementById('audioEnabled').checked;
@@ -184,6 +184,11 @@ class WebRTCCallClient {
         try {
             this.showSetupStatus('Connecting...');
 
+            // Without a token of their own, demo users get one for this room
+            if (!authToken) {
+                authToken = await this.requestToken(displayName, roomId);
+            }
+
             // Get user media
             const constraints = {
                 audio: audioEnabled,
@@ -298,6 +303,19 @@ class WebRTCCallClient {
         }
     }
 
+    async requestToken(username, roomId) {
+        const response = await fetch('/auth/token', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ username: username, room: roomId })
+        });
+        if (!response.ok) {
+            throw new Error('Token request failed: ' + response.status);
+        }
+        const data = await response.json();
+        return data.token;
+    }
+
     async connectToSignalingServer() {
         return new Promise((resolve, reject) => {
             const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
@@ -1,6 +1,7 @@
 package call
 
 import (
+	"errors"
 	"log"
 	"sync"
 	"time"
@@ -17,12 +18,21 @@ type Manager struct {
 	rooms map[string]*Room
 	peers map[string]*Peer
 	mu    sync.RWMutex
+	// tokenValidator verifies tokens sent in auth messages
+	tokenValidator TokenValidator
 	// redis      *RedisClient // For scaling - TODO
 }
 
 // Ensure Manager implements ws.CallManager
 var _ ws.CallManager = (*Manager)(nil)
 
+// defaultRole is the participant role of users whose identity carries none
+const defaultRole = "participant"
+
+// TokenValidator verifies a token sent in an auth message and returns the
+// identity it carries
+type TokenValidator func(token string) (*ws.Identity, error)
+
 // Room represents a call room
 type Room struct {
 	ID           string
@@ -47,133 +57,176 @@ type Peer struct {
 	IsOnHold    bool
 }
 
-// msgTypeToString converts numeric message type to string
-func msgTypeToString(msgType int) string {
-	switch msgType {
-	case 16:
-		return "auth"
-	case 17:
-		return "join"
-	case 18:
-		return "offer"
-	case 19:
-		return "answer"
-	case 20:
-		return "ice-candidate"
-	case 21:
-		return "mute"
-	case 22:
-		return "unmute"
-	case 23:
-		return "hold"
-	case 24:
-		return "dtmf"
-	case 25:
-		return "joined"
-	case 26:
-		return "peer-joined"
-	case 27:
-		return "peer-left"
-	case 28:
-		return "call-state-changed"
-	case 29:
-		return "recording-started"
-	case 30:
-		return "recording-finished"
-	default:
-		return "unknown"
-	}
-}
-
-// NewManager creates a new call manager
+// NewManager creates a new call manager and installs the handlers of the
+// signaling message types on the hub
 func NewManager(db ws.Database, hub *ws.Hub) *Manager {
-	return &Manager{
+	m := &Manager{
 		db:    db,
 		hub:   hub,
 		rooms: make(map[string]*Room),
 		peers: make(map[string]*Peer),
 	}
+	m.registerHandlers()
+	return m
 }
 
-// HandleSignalingMessage processes WebRTC signaling messages
-func (m *Manager) HandleSignalingMessage(socketID string, msg ws.Message) {
-	socket := m.hub.GetSocket(socketID)
-	if socket == nil {
-		log.Printf("Socket not found: %s", socketID)
-		return
+// signalingType is a message type handled by the manager
+type signalingType struct {
+	code    int
+	payload interface{}
+	handler ws.MessageHandler
+}
+
+// signalingTypes returns the message types handled by the manager with the
+// payload their Data is decoded into
+func (m *Manager) signalingTypes() []signalingType {
+	return []signalingType{
+		{ws.MsgAuth, ws.AuthPayload{}, m.handleAuth},
+		{ws.MsgJoin, ws.JoinPayload{}, m.handleJoin},
+		{ws.MsgOffer, ws.SDPPayload{}, m.handleOffer},
+		{ws.MsgAnswer, ws.SDPPayload{}, m.handleAnswer},
+		{ws.MsgIceCandidate, ws.ICEPayload{}, m.handleICECandidate},
+		{ws.MsgMute, ws.ControlPayload{}, m.handleMute},
+		{ws.MsgUnmute, ws.ControlPayload{}, m.handleMute},
+		{ws.MsgHold, ws.ControlPayload{}, m.handleHold},
+		{ws.MsgDTMF, ws.DTMFPayload{}, m.handleDTMF},
 	}
+}
 
-	var signalingMsg ws.SignalingMessage
-	if data, ok := msg.Data.(map[string]interface{}); ok {
-		if data["type"] != nil {
-			signalingMsg.Type = data["type"].(string)
-		} else {
-			signalingMsg.Type = msgTypeToString(msg.T)
+// registerHandlers attaches the signaling handlers to the hub's message
+// types and installs the middleware unwrapping signaling envelopes
+func (m *Manager) registerHandlers() {
+	for _, st := range m.signalingTypes() {
+		if err := m.hub.SetMessageTypeHandler(st.code, st.payload, st.handler); err != nil {
+			log.Printf("Signaling handler for %s not installed: %v", m.hub.MessageTypeName(st.code), err)
 		}
-		if data["id"] != nil {
-			signalingMsg.ID = data["id"].(string)
-		} else {
-			signalingMsg.ID = msg.ID
+	}
+	m.hub.Use(m.unwrapEnvelope)
+}
+
+// isSignaling reports whether the manager handles a message type
+func (m *Manager) isSignaling(code int) bool {
+	for _, st := range m.signalingTypes() {
+		if st.code == code {
+			return true
 		}
-		if data["payload"] != nil {
-			signalingMsg.Payload = data["payload"]
-		} else {
-			signalingMsg.Payload = data
+	}
+	return false
+}
+
+// unwrapEnvelope is middleware for signaling messages whose Data is a
+// signaling envelope with a type, ID and payload, as in ws.SignalingMessage.
+// The envelope's type and ID replace the message's and its payload becomes
+// the message's Data.
+func (m *Manager) unwrapEnvelope(next ws.MessageHandler) ws.MessageHandler {
+	return func(ctx *ws.Context) error {
+		if !ctx.Binary && m.isSignaling(ctx.Message.T) {
+			msg, err := m.unwrap(ctx.Message)
+			if err != nil {
+				return err
+			}
+			ctx.Message = msg
 		}
-	} else {
-		// Handle direct message format
-		signalingMsg.Type = msgTypeToString(msg.T)
-		signalingMsg.ID = msg.ID
-		signalingMsg.Payload = msg.Data
-	}
-
-	log.Printf("Handling signaling message: type=%s, socket=%s", signalingMsg.Type, socketID)
-
-	switch signalingMsg.Type {
-	case "auth":
-		m.handleAuth(socket, signalingMsg)
-	case "join":
-		m.handleJoin(socket, signalingMsg)
-	case "offer":
-		m.handleOffer(socket, signalingMsg)
-	case "answer":
-		m.handleAnswer(socket, signalingMsg)
-	case "ice-candidate":
-		m.handleICECandidate(socket, signalingMsg)
-	case "mute", "unmute":
-		m.handleMute(socket, signalingMsg)
-	case "hold":
-		m.handleHold(socket, signalingMsg)
-	case "dtmf":
-		m.handleDTMF(socket, signalingMsg)
-	default:
-		log.Printf("Unknown signaling message type: %s", signalingMsg.Type)
+		return next(ctx)
 	}
 }
 
-// handleAuth handles authentication
-func (m *Manager) handleAuth(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
+// unwrap returns a signaling message with its envelope, if any, removed
+func (m *Manager) unwrap(msg ws.Message) (ws.Message, error) {
+	data, ok := msg.Data.(map[string]interface{})
 	if !ok {
-		m.sendError(socket, "Invalid auth payload format")
-		return
+		return msg, nil
+	}
+	msgType, _ := data["type"].(string)
+	payload, hasPayload := data["payload"]
+	code := m.hub.MessageTypeCode(msgType)
+	if msgType == "" || !m.isSignaling(code) {
+		// A payload that merely has a type field, such as an SDP, is not
+		// an envelope
+		if hasPayload && msgType != "" {
+			return msg, &ws.Error{Code: ws.ErrorCodeUnknownType, Message: "unknown signaling message type " + msgType}
+		}
+		return msg, nil
 	}
 
-	token, ok := payload["token"].(string)
-	if !ok {
-		m.sendError(socket, "Missing token in auth payload")
+	msg.T = code
+	if id, ok := data["id"].(string); ok && id != "" {
+		msg.ID = id
+	}
+	if hasPayload && payload != nil {
+		msg.Data = payload
+	}
+	return msg, nil
+}
+
+// SetTokenValidator sets how tokens sent in auth messages are verified.
+// Without one, only sockets authenticated during the handshake can join.
+func (m *Manager) SetTokenValidator(validator TokenValidator) {
+	m.tokenValidator = validator
+}
+
+// HandleSignalingMessage processes a signaling message outside the hub's
+// handlers, answering it on the socket
+//
+// Deprecated: NewManager installs the signaling handlers on the hub, which
+// routes messages to them directly.
+func (m *Manager) HandleSignalingMessage(socketID string, msg ws.Message) {
+	socket := m.hub.GetSocket(socketID)
+	if socket == nil {
+		log.Printf("Socket not found: %s", socketID)
 		return
 	}
 
-	// Validate JWT token
-	userID, err := m.validateToken(token)
+	msg, err := m.unwrap(msg)
 	if err != nil {
-		m.sendError(socket, "Invalid token")
+		socket.ReplyError(msg, err)
 		return
 	}
+	mt, _ := m.hub.LookupMessageType(msg.T)
+	if mt.Handler == nil || !m.isSignaling(msg.T) {
+		socket.ReplyError(msg, &ws.Error{Code: ws.ErrorCodeUnknownType, Message: "unknown signaling message type " + mt.Name})
+		return
+	}
+	ctx := &ws.Context{Context: socket.Context(), Socket: socket, Message: msg, Event: mt.Name}
+	if err := mt.Handler(ctx); err != nil {
+		socket.ReplyError(msg, err)
+		return
+	}
+
+	// Auth and join are answered by their handlers; relayed messages are
+	// acknowledged when they ask for it
+	if msg.Ack && msg.T != ws.MsgAuth && msg.T != ws.MsgJoin {
+		socket.Reply(msg, ws.Message{
+			T:    ws.MsgAck,
+			Data: map[string]string{"status": "received"},
+		})
+	}
+}
+
+// handleAuth handles authentication
+func (m *Manager) handleAuth(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.AuthPayload](ctx.Message.Data)
+	if err != nil {
+		return err
+	}
+	socket := ctx.Socket
 
-	// Store user ID in socket properties
-	socket.SetProperty("user_id", userID)
+	// Sockets authenticated during the handshake keep their identity
+	identity := socket.Identity()
+	if identity == nil {
+		if payload.Token == "" {
+			sendError(ctx, "Missing token in auth payload")
+			return nil
+		}
+
+		identity, err = m.validateToken(payload.Token)
+		if err != nil {
+			sendError(ctx, "Invalid token")
+			return nil
+		}
+		socket.SetIdentity(identity)
+	}
+	userID := identity.UserID
 
 	// Send success response
 	response := ws.Message{
@@ -183,52 +236,50 @@ func (m *Manager) handleAuth(socket *ws.Socket, msg ws.SignalingMessage) {
 			"user_id": userID,
 		},
 	}
-	socket.SendMessage(response)
+	ctx.Reply(response)
+	return nil
 }
 
 // handleJoin handles room joining
-func (m *Manager) handleJoin(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		m.sendError(socket, "Invalid join payload format")
-		return
+func (m *Manager) handleJoin(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.JoinPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	room, ok := payload["room"].(string)
-	if !ok {
-		m.sendError(socket, "Missing room in join payload")
-		return
+	socket := ctx.Socket
+	room := payload.Room
+	userID := socket.UserID()
+	if userID == "" {
+		sendError(ctx, "Not authenticated")
+		return nil
 	}
 
-	displayName, ok := payload["display_name"].(string)
-	if !ok {
-		m.sendError(socket, "Missing display_name in join payload")
-		return
+	// Tokens may be scoped to a single room and carry the participant role
+	claims := socket.Identity().Claims
+	if scoped, _ := claims["room"].(string); scoped != "" && scoped != room {
+		sendError(ctx, "Token is not valid for this room")
+		return nil
 	}
-
-	capabilities, _ := payload["capabilities"].(map[string]interface{})
-
-	userID := socket.GetProperty("user_id")
-	if userID == nil {
-		m.sendError(socket, "Not authenticated")
-		return
+	role, _ := claims["role"].(string)
+	if role == "" {
+		role = defaultRole
 	}
 
 	// Create or get room
 	roomObj := m.getOrCreateRoom(room)
 	if roomObj == nil {
-		m.sendError(socket, "Failed to create or join room")
-		return
+		sendError(ctx, "Failed to create or join room")
+		return nil
 	}
 
 	// Create peer
 	peer := &Peer{
 		ID:          socket.ID,
-		UserID:      userID.(string),
+		UserID:      userID,
 		RoomID:      room,
 		Socket:      socket,
-		Role:        "participant", // Default role
-		DisplayName: displayName,
+		Role:        role,
+		DisplayName: payload.DisplayName,
 		JoinedAt:    time.Now(),
 		IsMuted:     false,
 		IsOnHold:    false,
@@ -246,7 +297,7 @@ func (m *Manager) handleJoin(socket *ws.Socket, msg ws.SignalingMessage) {
 
 	// Add participant to database
 	if m.db != nil {
-		_, err := m.db.AddParticipant(roomObj.CallID, userID.(string), peer.Role, "", capabilities)
+		_, err := m.db.AddParticipant(roomObj.CallID, userID, peer.Role, "", payload.Capabilities)
 		if err != nil {
 			log.Printf("Error adding participant: %v", err)
 		}
@@ -261,7 +312,7 @@ func (m *Manager) handleJoin(socket *ws.Socket, msg ws.SignalingMessage) {
 			"room_state":     roomState,
 		},
 	}
-	socket.SendMessage(joinedMsg)
+	ctx.Reply(joinedMsg)
 
 	// Notify other participants
 	peerJoinedMsg := ws.Message{
@@ -276,174 +327,129 @@ func (m *Manager) handleJoin(socket *ws.Socket, msg ws.SignalingMessage) {
 		},
 	}
 	m.broadcastToRoomExceptPtr(roomObj, peerJoinedMsg, socket.ID)
+	return nil
 }
 
 // handleOffer handles WebRTC offer
-func (m *Manager) handleOffer(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	sdp, ok := payload["sdp"].(string)
-	if !ok {
-		return
-	}
-
-	callID, ok := payload["call_id"].(string)
-	if !ok {
-		callID = ""
+func (m *Manager) handleOffer(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.SDPPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
 	// Forward offer to other participants in the room
 	offerMsg := ws.Message{
 		T: ws.MsgOffer,
 		Data: map[string]interface{}{
-			"sdp":     sdp,
-			"call_id": callID,
-			"from":    socket.ID,
+			"sdp":     payload.SDP,
+			"call_id": payload.CallID.String(),
+			"from":    ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, offerMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, offerMsg, ctx.Socket.ID)
+	return nil
 }
 
 // handleAnswer handles WebRTC answer
-func (m *Manager) handleAnswer(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	sdp, ok := payload["sdp"].(string)
-	if !ok {
-		return
-	}
-
-	callID, ok := payload["call_id"].(string)
-	if !ok {
-		callID = ""
+func (m *Manager) handleAnswer(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.SDPPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
 	// Forward answer to the target participant
 	answerMsg := ws.Message{
 		T: ws.MsgAnswer,
 		Data: map[string]interface{}{
-			"sdp":     sdp,
-			"call_id": callID,
-			"from":    socket.ID,
+			"sdp":     payload.SDP,
+			"call_id": payload.CallID.String(),
+			"from":    ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, answerMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, answerMsg, ctx.Socket.ID)
+	return nil
 }
 
 // handleICECandidate handles ICE candidates
-func (m *Manager) handleICECandidate(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	candidate, ok := payload["candidate"].(string)
-	if !ok {
-		return
-	}
-
-	sdpMid, ok := payload["sdpMid"].(string)
-	if !ok {
-		sdpMid = ""
-	}
-
-	sdpMLineIndex, ok := payload["sdpMLineIndex"].(float64)
-	if !ok {
-		sdpMLineIndex = 0
+func (m *Manager) handleICECandidate(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.ICEPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
 	// Forward ICE candidate to other participants
 	iceMsg := ws.Message{
 		T: ws.MsgIceCandidate,
 		Data: map[string]interface{}{
-			"candidate":     candidate,
-			"sdpMid":        sdpMid,
-			"sdpMLineIndex": int(sdpMLineIndex),
-			"from":          socket.ID,
+			"candidate":     payload.Candidate,
+			"sdpMid":        payload.SDPMid,
+			"sdpMLineIndex": payload.SDPMLineIndex,
+			"from":          ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, iceMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, iceMsg, ctx.Socket.ID)
+	return nil
 }
 
 // handleMute handles mute/unmute
-func (m *Manager) handleMute(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	callID, ok := payload["call_id"].(string)
-	if !ok {
-		callID = ""
+func (m *Manager) handleMute(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.ControlPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	track, ok := payload["track"].(string)
-	if !ok {
+	track := payload.Track
+	if track == "" {
 		track = "audio"
 	}
 
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
-	isMuted := (msg.Type == "mute")
+	isMuted := (ctx.Message.T == ws.MsgMute)
 	peer.IsMuted = isMuted
 
 	// Broadcast mute status
 	muteMsg := ws.Message{
 		T: ws.MsgMute,
 		Data: map[string]interface{}{
-			"call_id": callID,
+			"call_id": payload.CallID.String(),
 			"track":   track,
 			"muted":   isMuted,
-			"from":    socket.ID,
+			"from":    ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, muteMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, muteMsg, ctx.Socket.ID)
+	return nil
 }
 
 // handleHold handles call hold
-func (m *Manager) handleHold(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	callID, ok := payload["call_id"].(string)
-	if !ok {
-		callID = ""
+func (m *Manager) handleHold(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.ControlPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	track, ok := payload["track"].(string)
-	if !ok {
+	track := payload.Track
+	if track == "" {
 		track = "audio"
 	}
 
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
 	peer.IsOnHold = true
@@ -452,46 +458,37 @@ func (m *Manager) handleHold(socket *ws.Socket, msg ws.SignalingMessage) {
 	holdMsg := ws.Message{
 		T: ws.MsgHold,
 		Data: map[string]interface{}{
-			"call_id": callID,
+			"call_id": payload.CallID.String(),
 			"track":   track,
-			"from":    socket.ID,
+			"from":    ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, holdMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, holdMsg, ctx.Socket.ID)
+	return nil
 }
 
 // handleDTMF handles DTMF tones
-func (m *Manager) handleDTMF(socket *ws.Socket, msg ws.SignalingMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	callID, ok := payload["call_id"].(string)
-	if !ok {
-		callID = ""
-	}
-
-	tones, ok := payload["tones"].(string)
-	if !ok {
-		return
+func (m *Manager) handleDTMF(ctx *ws.Context) error {
+	payload, err := ws.DecodePayload[ws.DTMFPayload](ctx.Message.Data)
+	if err != nil {
+		return err
 	}
-
-	peer := m.getPeer(socket.ID)
+	peer := m.getPeer(ctx.Socket.ID)
 	if peer == nil {
-		return
+		return nil
 	}
 
 	// Forward DTMF to other participants
 	dtmfMsg := ws.Message{
 		T: ws.MsgDTMF,
 		Data: map[string]interface{}{
-			"call_id": callID,
-			"tones":   tones,
-			"from":    socket.ID,
+			"call_id": payload.CallID.String(),
+			"tones":   payload.Tones,
+			"from":    ctx.Socket.ID,
 		},
 	}
-	m.broadcastToRoomExcept(peer.RoomID, dtmfMsg, socket.ID)
+	m.broadcastToRoomExcept(peer.RoomID, dtmfMsg, ctx.Socket.ID)
+	return nil
 }
 
 // HandleDisconnect handles peer disconnection
@@ -633,18 +630,27 @@ func (m *Manager) getRoomState(room *Room) ws.RoomState {
 	}
 }
 
-func (m *Manager) sendError(socket *ws.Socket, message string) {
-	errorMsg := ws.Message{
+// sendError answers the handled signaling message with an error
+func sendError(ctx *ws.Context, message string) {
+	ctx.Reply(ws.Message{
 		T: ws.MsgError,
 		Data: map[string]interface{}{
 			"message": message,
 		},
-	}
-	socket.SendMessage(errorMsg)
+	})
 }
 
-func (m *Manager) validateToken(token string) (string, error) {
-	// Placeholder JWT validation
-	// In real implementation, validate JWT and return user ID
-	return "user123", nil
+// validateToken verifies a token from an auth message
+func (m *Manager) validateToken(token string) (*ws.Identity, error) {
+	if m.tokenValidator == nil {
+		return nil, errors.New("no token validator configured")
+	}
+	identity, err := m.tokenValidator(token)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil || identity.UserID == "" {
+		return nil, errors.New("token carries no user ID")
+	}
+	return identity, nil
 }
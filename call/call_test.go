@@ -0,0 +1,186 @@
+package call
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oarkflow/ws"
+	"github.com/oarkflow/ws/client"
+)
+
+func TestSignalingHandlersInstalled(t *testing.T) {
+	hub := ws.NewHub(nil)
+	m := NewManager(nil, hub)
+	for _, st := range m.signalingTypes() {
+		mt, ok := hub.LookupMessageType(st.code)
+		if !ok || mt.Handler == nil || mt.Payload == nil {
+			t.Errorf("type %d: %+v, want a handler and payload", st.code, mt)
+		}
+	}
+	for _, code := range []int{ws.MsgBroadcast, ws.MsgDirectCallInvite, ws.MsgPeerLeft} {
+		if mt, _ := hub.LookupMessageType(code); mt.Handler != nil {
+			t.Errorf("type %d has a handler", code)
+		}
+	}
+}
+
+func TestUnwrapEnvelope(t *testing.T) {
+	m := NewManager(nil, ws.NewHub(nil))
+	sdp := map[string]interface{}{"sdp": "v=0", "type": "offer"}
+
+	tests := []struct {
+		name    string
+		msg     ws.Message
+		want    ws.Message
+		wantErr bool
+	}{
+		{
+			"plain payload",
+			ws.Message{T: ws.MsgJoin, ID: "1", Data: map[string]interface{}{"room": "r"}},
+			ws.Message{T: ws.MsgJoin, ID: "1", Data: map[string]interface{}{"room": "r"}},
+			false,
+		},
+		{
+			"envelope",
+			ws.Message{T: ws.MsgJoin, Data: map[string]interface{}{"type": "join", "id": "2", "payload": map[string]interface{}{"room": "r"}}},
+			ws.Message{T: ws.MsgJoin, ID: "2", Data: map[string]interface{}{"room": "r"}},
+			false,
+		},
+		{
+			"envelope changes type",
+			ws.Message{T: ws.MsgMute, ID: "3", Data: map[string]interface{}{"type": "unmute", "payload": map[string]interface{}{"track": "video"}}},
+			ws.Message{T: ws.MsgUnmute, ID: "3", Data: map[string]interface{}{"track": "video"}},
+			false,
+		},
+		{
+			"SDP with a type field",
+			ws.Message{T: ws.MsgOffer, Data: sdp},
+			ws.Message{T: ws.MsgOffer, Data: sdp},
+			false,
+		},
+		{
+			"non-string type",
+			ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"type": 5, "payload": "x"}},
+			ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"type": 5, "payload": "x"}},
+			false,
+		},
+		{
+			"unknown envelope type",
+			ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"type": "bogus", "payload": map[string]interface{}{}}},
+			ws.Message{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := m.unwrap(tt.msg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// startManager starts a server with a call manager whose sockets are
+// authenticated as alice and returns its URL
+func startManager(t *testing.T) string {
+	t.Helper()
+	server := ws.NewServer()
+	server.SetCallManager(NewManager(nil, server.GetHub()))
+	server.SetAuthenticator(func(r *http.Request) (*ws.Identity, error) {
+		return &ws.Identity{UserID: "alice"}, nil
+	})
+	hs := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(hs.Close)
+	return "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+// dial connects a client to url
+func dial(t *testing.T, url string, opts client.Options) *client.Client {
+	t.Helper()
+	c, err := client.Dial(context.Background(), url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSignalingRequests(t *testing.T) {
+	c := dial(t, startManager(t), client.Options{})
+
+	tests := []struct {
+		name     string
+		msg      ws.Message
+		wantType int
+		wantCode int
+	}{
+		{"join without room", ws.Message{T: ws.MsgJoin, Data: map[string]interface{}{}}, ws.MsgError, ws.ErrorCodeInvalidPayload},
+		{"join", ws.Message{T: ws.MsgJoin, Data: map[string]interface{}{"room": "r1", "display_name": "Alice"}}, ws.MsgJoined, 0},
+		{"join in envelope", ws.Message{T: ws.MsgJoin, Data: map[string]interface{}{"type": "join", "payload": map[string]interface{}{"room": "r2"}}}, ws.MsgJoined, 0},
+		{"offer", ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"sdp": "v=0"}}, ws.MsgAck, 0},
+		{"offer without SDP", ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{}}, ws.MsgError, ws.ErrorCodeInvalidPayload},
+		{"dtmf without tones", ws.Message{T: ws.MsgDTMF}, ws.MsgError, ws.ErrorCodeInvalidPayload},
+		{"unknown envelope type", ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"type": "bogus", "payload": map[string]interface{}{}}}, ws.MsgError, ws.ErrorCodeUnknownType},
+		{"direct call invite", ws.Message{T: ws.MsgDirectCallInvite, Data: map[string]interface{}{"call_id": "c1"}}, ws.MsgAck, 0},
+		{"direct call ringing", ws.Message{T: ws.MsgDirectCallRinging}, ws.MsgAck, 0},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		reply, err := c.Request(ctx, tt.msg)
+		cancel()
+		if reply.T != tt.wantType || reply.Code != tt.wantCode {
+			t.Errorf("%s: reply = %+v (%v), want type %d code %d", tt.name, reply, err, tt.wantType, tt.wantCode)
+		}
+	}
+}
+
+func TestRelayedCallID(t *testing.T) {
+	url := startManager(t)
+	received := make(chan ws.Message, 8)
+	caller := dial(t, url, client.Options{})
+	callee := dial(t, url, client.Options{OnMessage: func(msg ws.Message) {
+		if msg.T == ws.MsgOffer || msg.T == ws.MsgDTMF {
+			received <- msg
+		}
+	}})
+	ctx := context.Background()
+	for _, c := range []*client.Client{callee, caller} {
+		if _, err := c.Request(ctx, ws.Message{T: ws.MsgJoin, Data: map[string]interface{}{"room": "r1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	callID := uuid.New().String()
+	tests := []struct {
+		name   string
+		msg    ws.Message
+		callID string
+	}{
+		{"room ID", ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"sdp": "v=0", "call_id": "r1"}}, "r1"},
+		{"UUID", ws.Message{T: ws.MsgOffer, Data: map[string]interface{}{"sdp": "v=0", "call_id": callID}}, callID},
+		{"typed payload", ws.Message{T: ws.MsgDTMF, Data: ws.DTMFPayload{CallID: ws.NewCallRef("r1"), Tones: "1"}}, "r1"},
+	}
+	for _, tt := range tests {
+		if _, err := caller.Request(ctx, tt.msg); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		select {
+		case msg := <-received:
+			data, _ := msg.Data.(map[string]interface{})
+			if data["call_id"] != tt.callID {
+				t.Errorf("%s: relayed call_id = %v, want %q", tt.name, data["call_id"], tt.callID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: message not relayed", tt.name)
+		}
+	}
+}
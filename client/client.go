@@ -0,0 +1,604 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oarkflow/ws"
+)
+
+// Reconnect defaults
+const (
+	DefaultMinBackoff       = 500 * time.Millisecond
+	DefaultMaxBackoff       = 30 * time.Second
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned by send methods while the client is
+	// disconnected or reconnecting
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrClosed is returned after Close has been called
+	ErrClosed = errors.New("client: closed")
+	// ErrBadHandshake is returned when the server does not accept the upgrade
+	ErrBadHandshake = errors.New("client: bad handshake")
+	// ErrConnectionLost is returned by Request when the connection drops
+	// before the reply arrives
+	ErrConnectionLost = errors.New("client: connection lost")
+)
+
+// codecs holds the codecs of the built-in subprotocols. The text protocol
+// sends commands and receives JSON, so it has no codec of its own.
+var codecs = map[string]ws.Codec{
+	"":                    ws.JSONCodec{},
+	ws.SubprotocolJSON:    ws.JSONCodec{},
+	ws.SubprotocolCompact: ws.CompactCodec{},
+	ws.SubprotocolMsgPack: ws.MsgPackCodec{},
+	ws.SubprotocolCBOR:    ws.CBORCodec{},
+}
+
+// Options configures a Client
+type Options struct {
+	// Header holds extra headers sent with the opening handshake, e.g.
+	// Authorization
+	Header http.Header
+	// TLSConfig is used for wss:// URLs
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds dialing plus the opening handshake
+	HandshakeTimeout time.Duration
+	// Subprotocol is requested during the handshake when set, e.g.
+	// ws.SubprotocolCompact; the server must accept it
+	Subprotocol string
+	// Codec encodes and decodes messages; it must match Subprotocol. It
+	// defaults to the codec of a built-in Subprotocol, or ws.JSONCodec
+	// without one.
+	Codec ws.Codec
+
+	// Reconnect redials with exponential backoff after the connection drops
+	Reconnect bool
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetries stops reconnecting after this many failed attempts in a
+	// row; 0 retries forever
+	MaxRetries int
+
+	// OnMessage is called for every decoded Message except replies to
+	// Request
+	OnMessage func(msg ws.Message)
+	// OnBinary is called for every binary message
+	OnBinary func(data []byte)
+	// OnConnect is called after every successful (re)connect, once topics
+	// have been re-subscribed
+	OnConnect func()
+	// OnDisconnect is called when the connection drops
+	OnDisconnect func(err error)
+}
+
+// Client is a WebSocket client speaking the hub's unified Message protocol
+type Client struct {
+	url  *url.URL
+	opts Options
+
+	mu     sync.RWMutex
+	conn   *ws.Connection
+	topics map[string]bool
+	alias  string
+	closed bool
+	done   chan struct{}
+	// pending holds the requests awaiting a reply, by message ID
+	pending map[string]chan ws.Message
+}
+
+// Dial connects to a ws:// or wss:// URL. When opts.Reconnect is set the
+// client keeps redialing after the connection drops until Close is called.
+func Dial(ctx context.Context, rawURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("client: unsupported scheme %q", u.Scheme)
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if opts.Codec == nil {
+		codec, builtin := codecs[opts.Subprotocol]
+		if !builtin {
+			return nil, fmt.Errorf("client: no codec for subprotocol %q", opts.Subprotocol)
+		}
+		opts.Codec = codec
+	}
+
+	c := &Client{
+		url:     u,
+		opts:    opts,
+		topics:  make(map[string]bool),
+		done:    make(chan struct{}),
+		pending: make(map[string]chan ws.Message),
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.setConn(conn)
+	go c.readLoop(conn)
+	return c, nil
+}
+
+// dial opens the TCP/TLS connection and performs the opening handshake
+func (c *Client) dial(ctx context.Context) (*ws.Connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.HandshakeTimeout)
+	defer cancel()
+
+	host := c.url.Host
+	if c.url.Port() == "" {
+		if c.url.Scheme == "wss" {
+			host = net.JoinHostPort(c.url.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(c.url.Hostname(), "80")
+		}
+	}
+
+	var netConn net.Conn
+	var err error
+	if c.url.Scheme == "wss" {
+		cfg := c.opts.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		} else {
+			cfg = cfg.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = c.url.Hostname()
+		}
+		dialer := &tls.Dialer{Config: cfg}
+		netConn, err = dialer.DialContext(ctx, "tcp", host)
+	} else {
+		var dialer net.Dialer
+		netConn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	reader, err := c.handshake(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return ws.NewClientConnection(netConn, reader), nil
+}
+
+// handshake sends the upgrade request and validates the response
+func (c *Client) handshake(netConn net.Conn) (*bufio.Reader, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        c.url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       c.url.Host,
+	}
+	for name, values := range c.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if c.opts.Subprotocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", c.opts.Subprotocol)
+	}
+
+	if err := req.Write(netConn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != ws.ComputeAcceptKey(key) {
+		return nil, fmt.Errorf("%w: status %d", ErrBadHandshake, resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != c.opts.Subprotocol {
+		return nil, fmt.Errorf("%w: subprotocol %q not accepted", ErrBadHandshake, c.opts.Subprotocol)
+	}
+	return reader, nil
+}
+
+// setConn installs a fresh connection
+func (c *Client) setConn(conn *ws.Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+}
+
+// readLoop dispatches incoming messages until the connection drops, then
+// hands over to reconnect
+func (c *Client) readLoop(conn *ws.Connection) {
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect()
+	}
+
+	var err error
+	for {
+		var messageType int
+		var payload []byte
+		messageType, payload, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		switch messageType {
+		case c.opts.Codec.MessageType():
+			msg, decodeErr := c.opts.Codec.Decode(payload)
+			if decodeErr != nil {
+				log.Printf("client: dropping undecodable message: %v", decodeErr)
+				continue
+			}
+			if c.resolveReply(msg) {
+				continue
+			}
+			if c.opts.OnMessage != nil {
+				c.opts.OnMessage(msg)
+			}
+		case ws.BinaryMessage:
+			if c.opts.OnBinary != nil {
+				c.opts.OnBinary(payload)
+			}
+		}
+	}
+
+	conn.Close()
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	closed := c.closed
+	// Replies to requests sent on this connection will never arrive
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	if c.opts.OnDisconnect != nil {
+		c.opts.OnDisconnect(err)
+	}
+	if !closed && c.opts.Reconnect {
+		c.reconnect()
+	}
+}
+
+// reconnect redials with exponential backoff and full jitter, then restores
+// the alias and topic subscriptions
+func (c *Client) reconnect() {
+	backoff := c.opts.MinBackoff
+	for attempt := 1; c.opts.MaxRetries == 0 || attempt <= c.opts.MaxRetries; attempt++ {
+		delay := time.Duration(mrand.Int64N(int64(backoff)) + 1)
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+
+		conn, err := c.dial(context.Background())
+		if err != nil {
+			log.Printf("client: reconnect attempt %d failed: %v", attempt, err)
+			backoff *= 2
+			if backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		topics := make([]string, 0, len(c.topics))
+		for topic := range c.topics {
+			topics = append(topics, topic)
+		}
+		alias := c.alias
+		c.mu.Unlock()
+
+		if alias != "" {
+			c.Send(ws.Message{T: ws.MsgSetAlias, Data: map[string]string{"alias": alias}})
+		}
+		for _, topic := range topics {
+			c.Send(ws.Message{T: ws.MsgSubscribe, Topic: topic})
+		}
+
+		go c.readLoop(conn)
+		return
+	}
+	log.Printf("client: giving up after %d reconnect attempts", c.opts.MaxRetries)
+}
+
+// Send writes a unified Message
+func (c *Client) Send(msg ws.Message) error {
+	data, err := c.opts.Codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return c.write(c.opts.Codec.MessageType(), data)
+}
+
+// Request sends msg and waits for the server's reply, the message whose
+// ReplyTo is msg's ID. msg is given an ID if it has none and asks for an
+// ack, so it is answered even if handling it produces no reply. A MsgError
+// reply is returned along with its Err. Without a deadline on ctx the wait
+// is bounded by ws.DefaultRequestTimeout. If the connection drops first,
+// ErrConnectionLost is returned.
+func (c *Client) Request(ctx context.Context, msg ws.Message) (ws.Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ws.DefaultRequestTimeout)
+		defer cancel()
+	}
+	if msg.ID == "" {
+		msg.ID = ws.UUIDv7Generator{}.NewID()
+	}
+	msg.Ack = true
+
+	reply := make(chan ws.Message, 1)
+	c.mu.Lock()
+	c.pending[msg.ID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.Send(msg); err != nil {
+		return ws.Message{}, err
+	}
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return ws.Message{}, ErrConnectionLost
+		}
+		return resp, resp.Err()
+	case <-c.done:
+		return ws.Message{}, ErrClosed
+	case <-ctx.Done():
+		return ws.Message{}, ctx.Err()
+	}
+}
+
+// Reply answers a request from the server, such as one made with
+// ws.Socket.Request, referencing it in ReplyTo
+func (c *Client) Reply(request ws.Message, reply ws.Message) error {
+	if request.ID != "" {
+		reply.ReplyTo = request.ID
+	}
+	return c.Send(reply)
+}
+
+// resolveReply hands a reply to the Request awaiting it, reporting whether
+// one was
+func (c *Client) resolveReply(msg ws.Message) bool {
+	if msg.ReplyTo == "" {
+		return false
+	}
+	c.mu.Lock()
+	reply, waiting := c.pending[msg.ReplyTo]
+	delete(c.pending, msg.ReplyTo)
+	c.mu.Unlock()
+
+	if waiting {
+		reply <- msg
+	}
+	return waiting
+}
+
+// SendBinary writes a binary message. With a binary codec, binary frames
+// carry messages; send files with SendFile instead.
+func (c *Client) SendBinary(data []byte) error {
+	return c.write(ws.BinaryMessage, data)
+}
+
+// write sends a raw message on the current connection
+func (c *Client) write(messageType int, data []byte) error {
+	c.mu.RLock()
+	conn, closed := c.conn, c.closed
+	c.mu.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+// SendFile sends a file to a single socket (to), to a topic's subscribers,
+// or to everyone when both are empty. The metadata message is followed by
+// the raw bytes, or carries them inline when the codec is binary.
+func (c *Client) SendFile(filename string, content []byte, to, topic string) error {
+	data := map[string]interface{}{
+		"filename": filename,
+		"size":     len(content),
+	}
+	meta := ws.Message{T: ws.MsgFile, To: to, Topic: topic, Data: data}
+	if c.opts.Codec.MessageType() == ws.BinaryMessage {
+		data[ws.FileContentKey] = content
+		return c.Send(meta)
+	}
+	if err := c.Send(meta); err != nil {
+		return err
+	}
+	return c.SendBinary(content)
+}
+
+// Subscribe subscribes to a topic filter, which may use the wildcards "+"
+// (one level) and "#" (all remaining levels), e.g. "alerts/#". The
+// subscription is restored after a reconnect.
+func (c *Client) Subscribe(topic string) error {
+	c.mu.Lock()
+	c.topics[topic] = true
+	c.mu.Unlock()
+	return c.Send(ws.Message{T: ws.MsgSubscribe, Topic: topic})
+}
+
+// Unsubscribe unsubscribes from a topic
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+	return c.Send(ws.Message{T: ws.MsgUnsubscribe, Topic: topic})
+}
+
+// Topics returns the topics the client is subscribed to
+func (c *Client) Topics() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Broadcast publishes data to a topic, or to everyone when topic is empty
+func (c *Client) Broadcast(topic string, data interface{}) error {
+	return c.Send(ws.Message{T: ws.MsgBroadcast, Topic: topic, Data: data})
+}
+
+// Direct sends data to a single socket
+func (c *Client) Direct(to string, data interface{}) error {
+	return c.Send(ws.Message{T: ws.MsgDirect, To: to, Data: data})
+}
+
+// Thread posts a reply in a thread. to may be empty to broadcast the reply.
+func (c *Client) Thread(threadID, replyTo, to string, data interface{}) error {
+	return c.Send(ws.Message{T: ws.MsgThread, ThreadID: threadID, ReplyTo: replyTo, To: to, Data: data})
+}
+
+// Typing announces the typing state to other clients
+func (c *Client) Typing(typing bool) error {
+	return c.Send(ws.Message{T: ws.MsgTyping, Data: typing})
+}
+
+// SetAlias sets the display alias. The alias is restored after a reconnect.
+func (c *Client) SetAlias(alias string) error {
+	c.mu.Lock()
+	c.alias = alias
+	c.mu.Unlock()
+	return c.Send(ws.Message{T: ws.MsgSetAlias, Data: map[string]string{"alias": alias}})
+}
+
+// RequestUserList asks the server for the list of connected users
+func (c *Client) RequestUserList() error {
+	return c.Send(ws.Message{T: ws.MsgUserList})
+}
+
+// Signaling helpers
+
+// Auth authenticates with the call manager
+func (c *Client) Auth(token string) error {
+	return c.Send(ws.Message{T: ws.MsgAuth, Data: ws.AuthPayload{Token: token}})
+}
+
+// Join joins a call room
+func (c *Client) Join(payload ws.JoinPayload) error {
+	return c.Send(ws.Message{T: ws.MsgJoin, Data: payload})
+}
+
+// Offer sends a WebRTC offer
+func (c *Client) Offer(payload ws.SDPPayload) error {
+	return c.Send(ws.Message{T: ws.MsgOffer, Data: payload})
+}
+
+// Answer sends a WebRTC answer
+func (c *Client) Answer(payload ws.SDPPayload) error {
+	return c.Send(ws.Message{T: ws.MsgAnswer, Data: payload})
+}
+
+// ICECandidate sends an ICE candidate
+func (c *Client) ICECandidate(payload ws.ICEPayload) error {
+	return c.Send(ws.Message{T: ws.MsgIceCandidate, Data: payload})
+}
+
+// Mute mutes or unmutes a track
+func (c *Client) Mute(payload ws.ControlPayload, muted bool) error {
+	msgType := ws.MsgUnmute
+	if muted {
+		msgType = ws.MsgMute
+	}
+	return c.Send(ws.Message{T: msgType, Data: payload})
+}
+
+// Hold puts the call on hold
+func (c *Client) Hold(payload ws.ControlPayload) error {
+	return c.Send(ws.Message{T: ws.MsgHold, Data: payload})
+}
+
+// DTMF sends DTMF tones
+func (c *Client) DTMF(payload ws.DTMFPayload) error {
+	return c.Send(ws.Message{T: ws.MsgDTMF, Data: payload})
+}
+
+// Close performs the closing handshake and stops reconnecting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.WriteClose(ws.CloseNormalClosure, "")
+}
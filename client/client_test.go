@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/ws"
+)
+
+// startServer serves server on a test HTTP server and returns its ws:// URL
+func startServer(t *testing.T, server *ws.Server) string {
+	t.Helper()
+	hs := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(hs.Close)
+	return "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+// dial connects a client to url
+func dial(t *testing.T, url string, opts Options) *Client {
+	t.Helper()
+	c, err := Dial(context.Background(), url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestDial(t *testing.T) {
+	url := startServer(t, ws.NewServer())
+
+	tests := []struct {
+		name    string
+		url     string
+		opts    Options
+		wantErr error
+	}{
+		{"no subprotocol", url, Options{}, nil},
+		{"json", url, Options{Subprotocol: ws.SubprotocolJSON}, nil},
+		{"compact", url, Options{Subprotocol: ws.SubprotocolCompact}, nil},
+		{"msgpack", url, Options{Subprotocol: ws.SubprotocolMsgPack}, nil},
+		{"cbor", url, Options{Subprotocol: ws.SubprotocolCBOR}, nil},
+		{"custom subprotocol without codec", url, Options{Subprotocol: "custom.v1"}, errors.New("no codec")},
+		{"subprotocol the server lacks", url, Options{Subprotocol: "custom.v1", Codec: ws.JSONCodec{}}, ErrBadHandshake},
+		{"unsupported scheme", strings.Replace(url, "ws", "http", 1), Options{}, errors.New("unsupported scheme")},
+	}
+	for _, tt := range tests {
+		c, err := Dial(context.Background(), tt.url, tt.opts)
+		if tt.wantErr != nil {
+			if err == nil || !errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error()) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		// The codec follows the subprotocol, including replyTo
+		reply, err := c.Request(context.Background(), ws.Message{T: ws.MsgPing})
+		if err != nil || reply.T != ws.MsgPong {
+			t.Errorf("%s: ping = %+v, %v, want a pong", tt.name, reply, err)
+		}
+		c.Close()
+	}
+}
+
+func TestRequest(t *testing.T) {
+	server := ws.NewServer()
+	server.OnEvent("thread", func(ctx *ws.Context) error {
+		if ctx.Message.Data == "fail" {
+			return &ws.Error{Code: 409, Message: "conflict"}
+		}
+		ctx.Reply(ws.Message{T: ws.MsgThread, Data: "answer"})
+		return nil
+	})
+	c := dial(t, startServer(t, server), Options{})
+
+	tests := []struct {
+		name     string
+		msg      ws.Message
+		wantType int
+		wantErr  bool
+	}{
+		{"reply", ws.Message{T: ws.MsgThread, Data: "question"}, ws.MsgThread, false},
+		{"error", ws.Message{T: ws.MsgThread, Data: "fail"}, ws.MsgError, true},
+		{"ack", ws.Message{T: ws.MsgTyping, Data: true}, ws.MsgAck, false},
+		{"subscribe", ws.Message{T: ws.MsgSubscribe, Topic: "news"}, ws.MsgAck, false},
+	}
+	for _, tt := range tests {
+		reply, err := c.Request(context.Background(), tt.msg)
+		if (err != nil) != tt.wantErr || reply.T != tt.wantType {
+			t.Errorf("%s: reply = %+v, %v, want type %d", tt.name, reply, err, tt.wantType)
+		}
+	}
+}
+
+func TestRequestFailsWhenConnectionDrops(t *testing.T) {
+	server := ws.NewServer()
+	started, release := make(chan *ws.Socket, 1), make(chan struct{})
+	defer close(release)
+	server.GetHub().MustRegisterMessageType(ws.MessageType{
+		Code: 100,
+		Name: "slow",
+		Handler: func(ctx *ws.Context) error {
+			started <- ctx.Socket
+			<-release
+			return nil
+		},
+	})
+	c := dial(t, startServer(t, server), Options{})
+
+	go func() {
+		socket := <-started
+		socket.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Request(ctx, ws.Message{T: 100}); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("error = %v, want ErrConnectionLost", err)
+	}
+}
+
+func TestReconnectRestoresSubscriptions(t *testing.T) {
+	server := ws.NewServer()
+	sockets := make(chan *ws.Socket, 4)
+	server.OnConnect(func(socket *ws.Socket) { sockets <- socket })
+
+	connects := make(chan struct{}, 4)
+	received := make(chan ws.Message, 4)
+	c := dial(t, startServer(t, server), Options{
+		Reconnect:  true,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		OnConnect:  func() { connects <- struct{}{} },
+		OnMessage: func(msg ws.Message) {
+			if msg.T == ws.MsgBroadcast {
+				received <- msg
+			}
+		},
+	})
+	<-connects
+	if err := c.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetAlias("bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := <-sockets
+	tests := []string{"first connection", "after reconnect"}
+	for i, name := range tests {
+		if i > 0 {
+			socket.Close()
+			select {
+			case <-connects:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: client did not reconnect", name)
+			}
+			socket = <-sockets
+		}
+
+		// Requests are handled in order, so the subscription is in place
+		// once the ping is answered
+		if _, err := c.Request(context.Background(), ws.Message{T: ws.MsgPing}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if alias := socket.GetAlias(); alias != "bot" {
+			t.Errorf("%s: alias = %q, want bot", name, alias)
+		}
+		if err := server.GetHub().Publish("news", "broadcast", name); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Data != name {
+				t.Errorf("%s: received %+v", name, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: publish to news not received", name)
+		}
+	}
+
+	if topics := c.Topics(); len(topics) != 1 || topics[0] != "news" {
+		t.Errorf("topics = %v, want [news]", topics)
+	}
+}
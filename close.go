@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Close status codes (RFC 6455 section 7.4.1)
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+)
+
+// defaultCloseTimeout is how long to wait for the peer to answer a close
+// frame before the TCP connection is torn down
+const defaultCloseTimeout = 5 * time.Second
+
+// maxCloseReasonLen keeps the close frame within the 125 byte control frame
+// limit after the two byte status code
+const maxCloseReasonLen = 123
+
+var errCloseSent = errors.New("websocket: close frame already sent")
+
+// CloseError describes a close frame received from or sent to the peer
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+}
+
+// formatClosePayload builds the body of a close frame. CloseNoStatusReceived
+// and CloseAbnormalClosure must never be sent, so they produce an empty body.
+// Reasons too long for a control frame are truncated.
+func formatClosePayload(code int, reason string) []byte {
+	if code == CloseNoStatusReceived || code == CloseAbnormalClosure || code == 0 {
+		return nil
+	}
+	if len(reason) > maxCloseReasonLen {
+		// Cut at a rune boundary so the reason stays valid UTF-8
+		n := maxCloseReasonLen
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return payload
+}
+
+// parseClosePayload extracts the status code and reason from a close frame
+func parseClosePayload(payload []byte) (code int, reason string) {
+	if len(payload) < 2 {
+		return CloseNoStatusReceived, ""
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+// isValidCloseCode reports whether a status code may appear in a close frame
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= CloseNormalClosure && code <= CloseUnsupportedData:
+		return true
+	case code >= CloseInvalidFramePayloadData && code <= CloseTryAgainLater:
+		return true
+	case code >= 3000 && code <= 4999:
+		// Registered (3000-3999) and private use (4000-4999) codes
+		return true
+	}
+	return false
+}
+
+// validateClosePayload checks the status code and reason of a received close
+// frame
+func validateClosePayload(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	if len(payload) == 1 {
+		return errInvalidClosePayload
+	}
+	code, reason := parseClosePayload(payload)
+	if !isValidCloseCode(code) {
+		return errInvalidClosePayload
+	}
+	if !utf8.ValidString(reason) {
+		return errInvalidUTF8
+	}
+	return nil
+}
+
+// writeClose sends a close frame. Only the first close frame is sent; later
+// calls return errCloseSent.
+func (c *Connection) writeClose(code int, reason string) error {
+	c.lockWrite()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+	c.closeSent = true
+	c.setWriteDeadline()
+
+	if err := c.writeFrame(true, false, CloseMessage, formatClosePayload(code, reason)); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// closeWithTimeout starts the closing handshake and tears the TCP connection
+// down if the peer has not answered within the close timeout
+func (c *Connection) closeWithTimeout(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if err == errCloseSent {
+		return nil
+	}
+	if err != nil {
+		// The peer can no longer be reached, there is nothing to wait for
+		c.abort()
+		return err
+	}
+
+	timeout := c.closeTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	time.AfterFunc(timeout, c.abort)
+	return nil
+}
+
+// handleCloseFrame processes a close frame from the peer, echoing it back if
+// this side has not already started the closing handshake
+func (c *Connection) handleCloseFrame(payload []byte) *CloseError {
+	code, reason := parseClosePayload(payload)
+	// An error here means our own close frame already went out or the
+	// connection is gone; either way the handshake is over
+	c.writeClose(code, "")
+	return &CloseError{Code: code, Reason: reason}
+}
@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFormatClosePayload(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		reason     string
+		wantReason string
+		wantEmpty  bool
+	}{
+		{name: "normal", code: CloseNormalClosure, reason: "bye", wantReason: "bye"},
+		{name: "no status", code: CloseNoStatusReceived, reason: "ignored", wantEmpty: true},
+		{name: "abnormal", code: CloseAbnormalClosure, wantEmpty: true},
+		{name: "ascii truncated", code: CloseGoingAway, reason: strings.Repeat("a", 200), wantReason: strings.Repeat("a", maxCloseReasonLen)},
+		// 61 two-byte runes fill 122 bytes; the 62nd would straddle the limit
+		{name: "multi-byte truncated", code: CloseGoingAway, reason: strings.Repeat("é", 100), wantReason: strings.Repeat("é", 61)},
+		{name: "four-byte truncated", code: CloseServiceRestart, reason: strings.Repeat("𝄞", 40), wantReason: strings.Repeat("𝄞", 30)},
+	}
+	for _, tt := range tests {
+		payload := formatClosePayload(tt.code, tt.reason)
+		if tt.wantEmpty {
+			if len(payload) != 0 {
+				t.Errorf("%s: payload %q, want empty", tt.name, payload)
+			}
+			continue
+		}
+		if len(payload) > 125 {
+			t.Errorf("%s: payload is %d bytes", tt.name, len(payload))
+		}
+		code, reason := parseClosePayload(payload)
+		if code != tt.code || reason != tt.wantReason {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, code, reason, tt.code, tt.wantReason)
+		}
+		if !utf8.ValidString(reason) || validateClosePayload(payload) != nil {
+			t.Errorf("%s: truncated reason is not a valid close payload", tt.name)
+		}
+	}
+}
+
+func TestValidateClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{"empty", nil, nil},
+		{"code only", []byte{0x03, 0xe8}, nil},
+		{"one byte", []byte{0x03}, errInvalidClosePayload},
+		{"reserved code", []byte{0x03, 0xed}, errInvalidClosePayload},
+		{"private code", []byte{0x0f, 0xa0, 'o', 'k'}, nil},
+		{"invalid utf-8", []byte{0x03, 0xe8, 0xe2, 0x82}, errInvalidUTF8},
+	}
+	for _, tt := range tests {
+		if got := validateClosePayload(tt.payload); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oarkflow/ws/token"
+)
+
+// tokenIssuer is the iss claim of tokens issued by this server
+const tokenIssuer = "ws-call-server"
+
+// newTokenService creates the issuer behind /auth/token and the verifier for
+// handshakes and auth messages. Tokens are signed with the RSA or P-256 PEM
+// key in JWT_SIGNING_KEY, or else with the HS256 secret JWT_SECRET. When
+// JWKS_FILE is set tokens are verified against it instead, reloading it on
+// change, so it must list the signing key under JWT_KEY_ID.
+func newTokenService(ctx context.Context) (*token.Issuer, *token.Verifier, error) {
+	keyID := os.Getenv("JWT_KEY_ID")
+	if keyID == "" {
+		keyID = "default"
+	}
+
+	var key token.Key
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		signer, err := token.LoadPrivateKey(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, err = token.SignerKey(keyID, signer); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		if len(secret) == 0 {
+			log.Println("No JWT_SECRET or JWT_SIGNING_KEY provided, tokens will not survive a restart")
+			secret = make([]byte, 32)
+			rand.Read(secret)
+		}
+		key = token.HMACKey(keyID, secret)
+	}
+
+	issuer, err := token.NewIssuer(key, token.IssuerOptions{Issuer: tokenIssuer})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := token.NewKeySet(key.Public())
+	if path := os.Getenv("JWKS_FILE"); path != "" {
+		if keys, err = token.LoadJWKS(path); err != nil {
+			return nil, nil, err
+		}
+		go keys.Watch(ctx, 10*time.Second)
+	}
+	verifier := token.NewVerifier(keys, token.VerifierOptions{
+		Issuer: tokenIssuer,
+		Leeway: 30 * time.Second,
+	})
+	return issuer, verifier, nil
+}
+
+// demoUser is an account accepted by the token endpoint
+type demoUser struct {
+	password string
+	role     string
+}
+
+// demoCredentials checks credentials against AUTH_USERS, a comma-separated
+// list of user:password[:role]. Without it every request is rejected, unless
+// demo is set, in which case any username is accepted.
+func demoCredentials(demo bool) token.CredentialVerifier {
+	users := map[string]demoUser{}
+	for _, entry := range strings.Split(os.Getenv("AUTH_USERS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		user := demoUser{password: parts[1]}
+		if len(parts) == 3 {
+			user.role = parts[2]
+		}
+		users[parts[0]] = user
+	}
+	acceptAny := len(users) == 0 && demo
+	switch {
+	case acceptAny:
+		log.Println("Demo auth enabled, issuing tokens for any username")
+	case len(users) == 0:
+		log.Println("No AUTH_USERS provided, the token endpoint rejects all credentials (use -demo-auth to accept any username)")
+	}
+
+	return token.CredentialVerifierFunc(func(ctx context.Context, creds token.Credentials) (*token.Claims, error) {
+		if creds.Username == "" {
+			return nil, token.ErrInvalidCredentials
+		}
+		claims := &token.Claims{Subject: creds.Username, Name: creds.Username, Room: creds.Room}
+		if acceptAny {
+			return claims, nil
+		}
+		user, ok := users[creds.Username]
+		if !ok || user.password != creds.Password {
+			return nil, token.ErrInvalidCredentials
+		}
+		claims.Role = user.role
+		return claims, nil
+	})
+}
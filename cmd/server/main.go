@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 	"github.com/oarkflow/ws"
@@ -13,6 +19,9 @@ import (
 )
 
 func main() {
+	demoAuth := flag.Bool("demo-auth", false, "issue tokens for any username when AUTH_USERS is unset")
+	flag.Parse()
+
 	// Database connection string from environment
 	var db ws.Database
 	dbConnStr := os.Getenv("DATABASE_URL")
@@ -40,31 +49,56 @@ func main() {
 	// Set call manager on server
 	server.SetCallManager(callManager)
 
+	// Browsers may connect from this server's own pages and from the
+	// comma-separated ALLOWED_ORIGINS, e.g. "https://*.example.com"
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		server.SetAllowedOrigins(strings.Split(origins, ",")...)
+	}
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	issuer, verifier, err := newTokenService(watchCtx)
+	if err != nil {
+		log.Fatalf("Failed to set up tokens: %v", err)
+	}
+
+	// Tokens are optional during the handshake and may also be sent in an
+	// auth message
+	server.SetAuthenticator(func(r *http.Request) (*ws.Identity, error) {
+		if ws.BearerToken(r) == "" {
+			return nil, nil
+		}
+		return verifier.Authenticate(r)
+	})
+	callManager.SetTokenValidator(verifier.Identity)
+
 	// Set up event handlers
 	hub.OnConnect(func(socket *ws.Socket) {
 		log.Printf("Client connected: %s", socket.ID)
 	})
 
-	hub.OnMessage(func(socket *ws.Socket) {
-		// Handle WebRTC signaling messages
-		// This will be called for all messages, we need to filter
-	})
-
 	hub.OnClose(func(socket *ws.Socket) {
 		log.Printf("Client disconnected: %s", socket.ID)
 		callManager.HandleDisconnect(socket.ID)
 	})
 
-	// Override the message handler to route WebRTC messages to call manager
-	server.OnMessage(func(socket *ws.Socket) {
-		// This is a placeholder - in real implementation, we'd need to modify
-		// the server to pass messages to call manager
+	// Signaling is routed to the call manager by the server; only
+	// authenticated sockets may send it
+	server.OnMessage(func(ctx *ws.Context) error {
+		switch ctx.Message.T {
+		case ws.MsgOffer, ws.MsgAnswer, ws.MsgIceCandidate:
+			if ctx.Socket.UserID() == "" {
+				return errors.New("authentication required")
+			}
+			log.Printf("Signaling %s from %s (%d bytes)", ctx.Event, ctx.Socket.UserID(), len(ctx.Payload))
+		}
+		return nil
 	})
 
 	// REST endpoints for token management
-	http.HandleFunc("/auth/token", handleTokenRequest)
-	http.HandleFunc("/calls", handleCreateCall)
-	http.HandleFunc("/calls/", handleGetCall)
+	http.HandleFunc("/auth/token", server.CORS(issuer.Handler(demoCredentials(*demoAuth))))
+	http.HandleFunc("/calls", server.CORS(handleCreateCall))
+	http.HandleFunc("/calls/", server.CORS(handleGetCall))
 
 	// WebSocket endpoint
 	http.HandleFunc("/ws", server.HandleWebSocket)
@@ -90,22 +124,29 @@ func main() {
 	// Static files
 	http.Handle("/", http.FileServer(http.Dir("./views")))
 
-	log.Println("WebRTC Call Management Backend starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-// handleTokenRequest issues JWT tokens
-func handleTokenRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", 405)
-		return
+	httpServer := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Println("WebRTC Call Management Backend starting on :8080")
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Drain connections on SIGINT/SIGTERM so rolling deploys do not drop
+	// clients without a close frame
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
 	}
-
-	// TODO: Implement JWT token issuance
-	// This would validate user credentials and issue a JWT
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"token": "jwt_token_here"}`))
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("WebSocket shutdown: %v", err)
+	}
+	log.Println("Server stopped")
 }
 
 // handleCreateCall creates a new call
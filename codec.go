@@ -0,0 +1,300 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Built-in subprotocol names registered by NewServer
+const (
+	SubprotocolJSON    = "ws.json.v1"
+	SubprotocolCompact = "ws.compact.v1"
+	SubprotocolText    = "ws.text.v1"
+	SubprotocolMsgPack = "ws.msgpack.v1"
+	SubprotocolCBOR    = "ws.cbor.v1"
+)
+
+// FileContentKey carries file bytes inside a MsgFile message on connections
+// using a binary codec, where binary frames are reserved for messages
+const FileContentKey = "content"
+
+var errUnknownTextCommand = errors.New("codec: unknown text command")
+
+// Codec converts between Message values and wire payloads. A codec is bound
+// to each connection during the handshake so every payload is encoded and
+// decoded the same way. MessageType reports the frame type the codec's
+// payloads travel in: TextMessage or BinaryMessage.
+type Codec interface {
+	Encode(msg Message) ([]byte, error)
+	Decode(payload []byte) (Message, error)
+	MessageType() int
+}
+
+// isBinaryCodec reports whether codec payloads travel in binary frames
+func isBinaryCodec(codec Codec) bool {
+	return codec.MessageType() == BinaryMessage
+}
+
+// JSONCodec speaks the object format: {"t": 1, "topic": "...", "data": ...}
+type JSONCodec struct{}
+
+// Encode encodes msg as a JSON object
+func (JSONCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// MessageType returns TextMessage
+func (JSONCodec) MessageType() int {
+	return TextMessage
+}
+
+// Decode decodes a JSON object message
+func (JSONCodec) Decode(payload []byte) (Message, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return Message{}, err
+	}
+	return decodeObjectMessage(obj), nil
+}
+
+// CompactCodec speaks the array format: [type, topic?, data?, id?, to?, code?, ack?, replyTo?]
+type CompactCodec struct{}
+
+// Encode encodes msg as a JSON array, dropping trailing empty fields
+func (CompactCodec) Encode(msg Message) ([]byte, error) {
+	arr := []interface{}{msg.T, msg.Topic, msg.Data, msg.ID, msg.To, msg.Code, msg.Ack, msg.ReplyTo}
+	n := len(arr)
+	for n > 1 && isEmptyField(arr[n-1]) {
+		n--
+	}
+	return json.Marshal(arr[:n])
+}
+
+// MessageType returns TextMessage
+func (CompactCodec) MessageType() int {
+	return TextMessage
+}
+
+// isEmptyField reports whether a compact array field can be omitted
+func isEmptyField(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case int:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return false
+}
+
+// Decode decodes a JSON array message
+func (CompactCodec) Decode(payload []byte) (Message, error) {
+	var arr []interface{}
+	if err := json.Unmarshal(payload, &arr); err != nil {
+		return Message{}, err
+	}
+	return decodeArrayMessage(arr), nil
+}
+
+// TextCodec speaks the plain-text protocol: "subscribe:topic",
+// "unsubscribe:topic" and "publish:topic:data". Replies are sent as JSON
+// objects.
+type TextCodec struct{}
+
+// Encode encodes msg as a JSON object
+func (TextCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// MessageType returns TextMessage
+func (TextCodec) MessageType() int {
+	return TextMessage
+}
+
+// Decode parses a plain-text command
+func (TextCodec) Decode(payload []byte) (Message, error) {
+	message := string(payload)
+	switch {
+	case strings.HasPrefix(message, "subscribe:"):
+		return Message{T: MsgSubscribe, Topic: strings.TrimPrefix(message, "subscribe:")}, nil
+	case strings.HasPrefix(message, "unsubscribe:"):
+		return Message{T: MsgUnsubscribe, Topic: strings.TrimPrefix(message, "unsubscribe:")}, nil
+	case strings.HasPrefix(message, "publish:"):
+		parts := strings.SplitN(message, ":", 3)
+		if len(parts) == 3 {
+			return Message{T: MsgBroadcast, Topic: parts[1], Data: parts[2]}, nil
+		}
+	}
+	return Message{}, errUnknownTextCommand
+}
+
+// legacyCodec is used when the client does not request a subprotocol. It
+// guesses the format of every payload: array, object with "t", object with
+// a legacy "event" name, and finally the plain-text protocol. Event names
+// are resolved through types, the hub's registry, or the built-in types if
+// it is nil.
+type legacyCodec struct {
+	types *typeRegistry
+}
+
+// Encode encodes msg as a JSON object
+func (legacyCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// MessageType returns TextMessage
+func (legacyCodec) MessageType() int {
+	return TextMessage
+}
+
+// Decode detects the payload format and decodes it
+func (c legacyCodec) Decode(payload []byte) (Message, error) {
+	// Try to parse as JSON first (this handles both arrays and objects)
+	var jsonValue interface{}
+	if err := json.Unmarshal(payload, &jsonValue); err == nil {
+		// Check if it's an array (legacy ultra-compact format)
+		if arr, ok := jsonValue.([]interface{}); ok {
+			return decodeArrayMessage(arr), nil
+		}
+
+		// Check if it's an object (compact or legacy format)
+		if obj, ok := jsonValue.(map[string]interface{}); ok {
+			// Unified/compact format (has 't' field)
+			if _, hasT := obj["t"]; hasT {
+				return decodeObjectMessage(obj), nil
+			}
+
+			// Legacy format (has 'event' field)
+			if event, ok := obj["event"].(string); ok {
+				msg := Message{
+					T: c.typeCode(event),
+				}
+				if topic, ok := obj["topic"].(string); ok {
+					msg.Topic = topic
+				}
+				if data, exists := obj["data"]; exists {
+					msg.Data = data
+				}
+				if id, ok := obj["id"].(string); ok {
+					msg.ID = id
+				}
+				return msg, nil
+			}
+		}
+	}
+
+	// Fallback to simple text protocol
+	return TextCodec{}.Decode(payload)
+}
+
+// typeCode returns the code of a legacy event name
+func (c legacyCodec) typeCode(event string) int {
+	if c.types == nil {
+		return MessageTypeCode(event)
+	}
+	return c.types.code(event)
+}
+
+// decodeArrayMessage builds a Message from the array format
+func decodeArrayMessage(arr []interface{}) Message {
+	var msg Message
+	// [type, topic?, data?, id?, to?, code?, ack?, replyTo?]
+	if len(arr) > 0 {
+		switch t := arr[0].(type) {
+		case float64:
+			msg.T = int(t)
+		case int:
+			msg.T = t
+		}
+	}
+	if len(arr) > 1 {
+		if topic, ok := arr[1].(string); ok {
+			msg.Topic = topic
+		}
+	}
+	if len(arr) > 2 {
+		msg.Data = arr[2]
+	}
+	if len(arr) > 3 {
+		if id, ok := arr[3].(string); ok {
+			msg.ID = id
+		}
+	}
+	if len(arr) > 4 {
+		if to, ok := arr[4].(string); ok {
+			msg.To = to
+		}
+	}
+	if len(arr) > 5 {
+		switch code := arr[5].(type) {
+		case float64:
+			msg.Code = int(code)
+		case int:
+			msg.Code = code
+		}
+	}
+	if len(arr) > 6 {
+		msg.Ack, _ = arr[6].(bool)
+	}
+	if len(arr) > 7 {
+		msg.ReplyTo, _ = arr[7].(string)
+	}
+	return msg
+}
+
+// decodeObjectMessage builds a Message from the object format
+func decodeObjectMessage(obj map[string]interface{}) Message {
+	var msg Message
+	switch tv := obj["t"].(type) {
+	case float64:
+		msg.T = int(tv)
+	case int:
+		msg.T = tv
+	}
+	if topic, ok := obj["topic"].(string); ok {
+		msg.Topic = topic
+	}
+	if data, exists := obj["data"]; exists {
+		msg.Data = data
+	}
+	if id, ok := obj["id"].(string); ok {
+		msg.ID = id
+	}
+	if to, ok := obj["to"].(string); ok {
+		msg.To = to
+	}
+	if code, ok := obj["code"].(float64); ok {
+		msg.Code = int(code)
+	}
+	if threadID, ok := obj["threadId"].(string); ok {
+		msg.ThreadID = threadID
+	}
+	if replyTo, ok := obj["replyTo"].(string); ok {
+		msg.ReplyTo = replyTo
+	}
+	if ack, ok := obj["ack"].(bool); ok {
+		msg.Ack = ack
+	}
+	// Handle file-specific fields
+	if filename, ok := obj["filename"].(string); ok {
+		if msg.Data == nil {
+			msg.Data = make(map[string]interface{})
+		}
+		if dataMap, ok := msg.Data.(map[string]interface{}); ok {
+			dataMap["filename"] = filename
+		}
+	}
+	if size, ok := obj["size"].(float64); ok {
+		if msg.Data == nil {
+			msg.Data = make(map[string]interface{})
+		}
+		if dataMap, ok := msg.Data.(map[string]interface{}); ok {
+			dataMap["size"] = int64(size)
+		}
+	}
+	return msg
+}
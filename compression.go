@@ -0,0 +1,374 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// deflateExtension is the extension token for RFC 7692 compression
+const deflateExtension = "permessage-deflate"
+
+// deflateWindowSize is the LZ77 window used by compress/flate; it is also the
+// amount of history kept for decompression with context takeover
+const deflateWindowSize = 32 * 1024
+
+// deflateTail is appended to every compressed message before inflating: the
+// 0x00 0x00 0xff 0xff trailer stripped by the sender (RFC 7692 7.2.2) followed
+// by an empty final stored block so the reader reports io.EOF
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errDeflateTrailer = errors.New("websocket: compressed message does not end with an empty sync block")
+
+// CompressionOptions configures the permessage-deflate extension (RFC 7692)
+type CompressionOptions struct {
+	// Level is the compress/flate level. 0 selects flate.DefaultCompression;
+	// use WithLevel to select flate.NoCompression.
+	Level int
+	// Threshold is the payload size in bytes below which messages are sent
+	// uncompressed
+	Threshold int
+	// ServerNoContextTakeover resets the server's compressor after every
+	// message, trading ratio for memory
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover asks clients to reset their compressor after
+	// every message
+	ClientNoContextTakeover bool
+
+	// levelSet makes a Level of 0 mean flate.NoCompression
+	levelSet bool
+}
+
+// WithLevel returns the options with the compress/flate level set. Unlike
+// setting Level, it also accepts flate.NoCompression.
+func (o CompressionOptions) WithLevel(level int) CompressionOptions {
+	o.Level = level
+	o.levelSet = true
+	return o
+}
+
+// deflateParams holds the negotiated permessage-deflate parameters
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// String renders the parameters as a Sec-WebSocket-Extensions response value
+func (p deflateParams) String() string {
+	value := deflateExtension
+	if p.serverNoContextTakeover {
+		value += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		value += "; client_no_context_takeover"
+	}
+	return value
+}
+
+// negotiateDeflate picks the first acceptable permessage-deflate offer from
+// the request. It returns false when the client made no usable offer.
+func negotiateDeflate(r *http.Request, opts *CompressionOptions) (deflateParams, bool) {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(header, ",") {
+			params, ok := parseDeflateOffer(offer)
+			if !ok {
+				continue
+			}
+			if opts.ServerNoContextTakeover {
+				params.serverNoContextTakeover = true
+			}
+			if opts.ClientNoContextTakeover {
+				params.clientNoContextTakeover = true
+			}
+			return params, true
+		}
+	}
+	return deflateParams{}, false
+}
+
+// parseDeflateOffer parses a single extension offer, rejecting offers with
+// parameters the server cannot honour
+func parseDeflateOffer(offer string) (deflateParams, bool) {
+	var params deflateParams
+	parts := strings.Split(offer, ";")
+	if strings.TrimSpace(parts[0]) != deflateExtension {
+		return params, false
+	}
+
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch name {
+		case "server_no_context_takeover":
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			// compress/flate always uses a 32KB window, so a smaller
+			// server window cannot be honoured
+			if bits, err := strconv.Atoi(value); err != nil || bits != 15 {
+				return params, false
+			}
+		case "client_max_window_bits":
+			// Any client window up to 15 bits can be inflated
+			if value != "" {
+				if bits, err := strconv.Atoi(value); err != nil || bits < 8 || bits > 15 {
+					return params, false
+				}
+			}
+		default:
+			return params, false
+		}
+	}
+	return params, true
+}
+
+// deflateState holds the per-connection compressor and decompressor
+type deflateState struct {
+	level         int
+	threshold     int
+	writeTakeover bool // keep compressor context between messages
+	readTakeover  bool // keep decompressor history between messages
+	sink          deflateSink
+	fw            *flate.Writer
+	out           bytes.Buffer
+	fr            io.ReadCloser
+	dict          []byte
+
+	// Reused per message so inflating does not allocate a source reader
+	payload  bytes.Reader
+	src      inflateSource
+	recorder dictRecorder
+}
+
+// newDeflateState creates compression state from negotiated parameters
+func newDeflateState(params deflateParams, opts *CompressionOptions) *deflateState {
+	level := opts.Level
+	if level == 0 && !opts.levelSet {
+		level = flate.DefaultCompression
+	}
+	return &deflateState{
+		level:         level,
+		threshold:     opts.Threshold,
+		writeTakeover: !params.serverNoContextTakeover,
+		readTakeover:  !params.clientNoContextTakeover,
+	}
+}
+
+// deflateSink lets the long-lived flate.Writer switch destinations without
+// a Reset, which would discard the compression context
+type deflateSink struct {
+	w io.Writer
+}
+
+func (s *deflateSink) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// compressor returns the flate writer targeting dst, resetting its context
+// unless context takeover was negotiated
+func (d *deflateState) compressor(dst io.Writer) (*flate.Writer, error) {
+	d.sink.w = dst
+	if d.fw == nil {
+		fw, err := flate.NewWriter(&d.sink, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	} else if !d.writeTakeover {
+		d.fw.Reset(&d.sink)
+	}
+	return d.fw, nil
+}
+
+// shouldCompress reports whether a payload of size n should be compressed
+func (d *deflateState) shouldCompress(n int) bool {
+	return d != nil && n >= d.threshold
+}
+
+// compress deflates payload and strips the trailing sync marker. The returned
+// slice is only valid until the next call; callers must hold writeMu.
+func (d *deflateState) compress(payload []byte) ([]byte, error) {
+	d.out.Reset()
+	fw, err := d.compressor(&d.out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	compressed := d.out.Bytes()
+	if !bytes.HasSuffix(compressed, deflateTail[:4]) {
+		return nil, errDeflateTrailer
+	}
+	return compressed[:len(compressed)-4], nil
+}
+
+// byteReader is a reader the inflater can consume without buffering
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// inflateSource feeds the inflater a compressed message followed by
+// deflateTail. It implements io.ByteReader so flate reads it directly
+// instead of wrapping it in a new bufio.Reader.
+type inflateSource struct {
+	r    byteReader
+	tail int
+}
+
+func (s *inflateSource) Read(p []byte) (int, error) {
+	if s.r != nil {
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	if s.tail == len(deflateTail) {
+		return 0, io.EOF
+	}
+	n := copy(p, deflateTail[s.tail:])
+	s.tail += n
+	return n, nil
+}
+
+func (s *inflateSource) ReadByte() (byte, error) {
+	if s.r != nil {
+		b, err := s.r.ReadByte()
+		if err != io.EOF {
+			return b, err
+		}
+		s.r = nil
+	}
+	if s.tail == len(deflateTail) {
+		return 0, io.EOF
+	}
+	b := deflateTail[s.tail]
+	s.tail++
+	return b, nil
+}
+
+// dictRecorder reads inflated output and records it as the dictionary for
+// the next message when context takeover was negotiated
+type dictRecorder struct {
+	d *deflateState
+}
+
+func (r *dictRecorder) Read(p []byte) (int, error) {
+	n, err := r.d.fr.Read(p)
+	d := r.d
+	d.dict = append(d.dict, p[:n]...)
+	if len(d.dict) > 2*deflateWindowSize {
+		d.dict = append(d.dict[:0], d.dict[len(d.dict)-deflateWindowSize:]...)
+	}
+	return n, err
+}
+
+// inflater resets the decompressor to read the compressed message in r
+func (d *deflateState) inflater(r byteReader) (io.Reader, error) {
+	d.src = inflateSource{r: r}
+
+	var dict []byte
+	if d.readTakeover {
+		// flate copies the dictionary, so recording may reuse its memory
+		dict = d.dict
+	}
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(&d.src, dict)
+	} else if err := d.fr.(flate.Resetter).Reset(&d.src, dict); err != nil {
+		return nil, err
+	}
+
+	if !d.readTakeover {
+		return d.fr, nil
+	}
+	d.recorder.d = d
+	return &d.recorder, nil
+}
+
+// inflateError reports corrupt compressed data as a protocol error
+func inflateError(err error) error {
+	if _, ok := err.(flate.CorruptInputError); ok {
+		return &CloseError{Code: CloseInvalidFramePayloadData, Reason: fmt.Sprintf("inflate: %v", err)}
+	}
+	return err
+}
+
+// decompress inflates a complete compressed message. A positive limit caps
+// the inflated size so a small frame cannot expand into an unbounded buffer.
+func (d *deflateState) decompress(payload []byte, limit int64) ([]byte, error) {
+	d.payload.Reset(payload)
+	r, err := d.inflater(&d.payload)
+	if err != nil {
+		return nil, err
+	}
+	out, err := readAll(r, limit)
+	if err == errMessageTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &CloseError{Code: CloseInvalidFramePayloadData, Reason: fmt.Sprintf("inflate: %v", err)}
+	}
+	return out, nil
+}
+
+// truncWriter forwards everything except the final four bytes, which are
+// held back so the deflate sync marker can be dropped at the end of a stream
+type truncWriter struct {
+	w    io.Writer
+	tail [4]byte
+	n    int
+}
+
+func (t *truncWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	// Top up the held-back tail first
+	if t.n < len(t.tail) {
+		k := copy(t.tail[t.n:], p)
+		t.n += k
+		p = p[k:]
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+
+	// The tail plus p is more than four bytes: emit the oldest bytes and
+	// keep the last four
+	m := len(p)
+	if m > len(t.tail) {
+		m = len(t.tail)
+	}
+	if _, err := t.w.Write(t.tail[:m]); err != nil {
+		return 0, err
+	}
+	copy(t.tail[:], t.tail[m:])
+	if _, err := t.w.Write(p[:len(p)-m]); err != nil {
+		return 0, err
+	}
+	copy(t.tail[len(t.tail)-m:], p[len(p)-m:])
+	return written, nil
+}
+
+// finish verifies the held-back bytes are the deflate sync marker
+func (t *truncWriter) finish() error {
+	if t.n < len(t.tail) || !bytes.Equal(t.tail[:], deflateTail[:4]) {
+		return errDeflateTrailer
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"net/http"
+	"testing"
+)
+
+func TestParseDeflateOffer(t *testing.T) {
+	tests := []struct {
+		offer string
+		want  deflateParams
+		ok    bool
+	}{
+		{offer: "permessage-deflate", ok: true},
+		{offer: " permessage-deflate; client_max_window_bits", ok: true},
+		{offer: "permessage-deflate; server_no_context_takeover", want: deflateParams{serverNoContextTakeover: true}, ok: true},
+		{offer: "permessage-deflate; client_no_context_takeover", want: deflateParams{clientNoContextTakeover: true}, ok: true},
+		{offer: `permessage-deflate; server_max_window_bits="15"`, ok: true},
+		{offer: "permessage-deflate; server_max_window_bits=10"},
+		{offer: "permessage-deflate; client_max_window_bits=7"},
+		{offer: "permessage-deflate; unknown_param"},
+		{offer: "x-webkit-deflate-frame"},
+	}
+	for _, tt := range tests {
+		got, ok := parseDeflateOffer(tt.offer)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseDeflateOffer(%q) = %+v, %v; want %+v, %v", tt.offer, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/ws", nil)
+	r.Header.Add("Sec-WebSocket-Extensions", "permessage-deflate; server_max_window_bits=10, permessage-deflate")
+
+	params, ok := negotiateDeflate(r, &CompressionOptions{ClientNoContextTakeover: true})
+	if !ok {
+		t.Fatal("acceptable offer was rejected")
+	}
+	if got, want := params.String(), "permessage-deflate; client_no_context_takeover"; got != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CompressionOptions
+		want int
+	}{
+		{"unset", CompressionOptions{}, flate.DefaultCompression},
+		{"best speed", CompressionOptions{Level: flate.BestSpeed}, flate.BestSpeed},
+		{"no compression", CompressionOptions{}.WithLevel(flate.NoCompression), flate.NoCompression},
+		{"huffman only", CompressionOptions{}.WithLevel(flate.HuffmanOnly), flate.HuffmanOnly},
+	}
+	payload := bytes.Repeat([]byte("compressible "), 100)
+	for _, tt := range tests {
+		d := newDeflateState(deflateParams{}, &tt.opts)
+		if d.level != tt.want {
+			t.Errorf("%s: level = %d, want %d", tt.name, d.level, tt.want)
+		}
+		compressed, err := d.compress(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Stored blocks are never smaller than their input
+		if stored := len(compressed) >= len(payload); stored != (tt.want == flate.NoCompression) {
+			t.Errorf("%s: %d bytes compressed to %d", tt.name, len(payload), len(compressed))
+		}
+	}
+}
+
+func TestDeflateContextTakeover(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"t":1,"topic":"general","data":"hello"}`), 20)
+	tests := []struct {
+		name     string
+		params   deflateParams
+		takeover bool
+	}{
+		{"takeover", deflateParams{}, true},
+		{"server no context takeover", deflateParams{serverNoContextTakeover: true}, false},
+	}
+	for _, tt := range tests {
+		d := newDeflateState(tt.params, &CompressionOptions{})
+		first, err := d.compress(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		firstLen := len(first)
+		second, err := d.compress(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// With the previous message as context, a repeat compresses to a
+		// back-reference
+		if shorter := len(second) < firstLen; shorter != tt.takeover {
+			t.Errorf("%s: first message %d bytes, second %d", tt.name, firstLen, len(second))
+		}
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	messages := [][]byte{
+		bytes.Repeat([]byte("hello world "), 1000),
+		bytes.Repeat([]byte("hello world "), 1000),
+		[]byte("hi"),
+		bytes.Repeat([]byte("héllo wörld € "), 300),
+	}
+	tests := []struct {
+		name         string
+		params       deflateParams
+		opts         CompressionOptions
+		fragmentSize int
+	}{
+		{name: "context takeover", opts: CompressionOptions{Threshold: 5}},
+		{name: "no context takeover", params: deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}, opts: CompressionOptions{Threshold: 5}},
+		{name: "fragmented", opts: CompressionOptions{Threshold: 5}, fragmentSize: 7},
+		{name: "no compression level", opts: CompressionOptions{}.WithLevel(flate.NoCompression)},
+	}
+	for _, tt := range tests {
+		client, server := connPair()
+		client.deflate = newDeflateState(tt.params, &tt.opts)
+		server.deflate = newDeflateState(tt.params, &tt.opts)
+		client.fragmentSize = tt.fragmentSize
+
+		errs := make(chan error, 1)
+		go func() {
+			for _, msg := range messages {
+				if err := client.writeMessage(TextMessage, msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		for i, want := range messages {
+			op, got, err := server.readMessage()
+			if err != nil || op != TextMessage || !bytes.Equal(got, want) {
+				t.Fatalf("%s: message %d: op %d, %d bytes, err %v", tt.name, i, op, len(got), err)
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("%s: write: %v", tt.name, err)
+		}
+	}
+}
@@ -49,8 +49,9 @@ func main() {
 		socket.SendMessage(topicListMsg)
 	})
 
-	hub.OnMessage(func(socket *ws.Socket) {
-		// log.Printf("Message from %s", socket.ID)
+	hub.OnMessage(func(ctx *ws.Context) error {
+		// log.Printf("Message %s from %s", ctx.Event, ctx.Socket.ID)
+		return nil
 	})
 
 	hub.OnClose(func(socket *ws.Socket) {
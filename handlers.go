@@ -0,0 +1,84 @@
+package ws
+
+import "context"
+
+// Context carries an inbound message to its handlers. It embeds the socket's
+// context, which is cancelled when the socket disconnects.
+type Context struct {
+	context.Context
+	Socket  *Socket
+	Message Message
+	// Payload is the raw frame payload the Message was decoded from
+	Payload []byte
+	// Event is the name of the message type, e.g. "broadcast"
+	Event string
+	// Binary is set for a raw binary frame such as file data, which has no
+	// decoded Message. Only middleware sees binary frames.
+	Binary bool
+
+	// replied is set once the message has been answered
+	replied bool
+}
+
+// MessageHandler handles an inbound message. Handlers of a socket run one at
+// a time on its read loop, in the order its messages arrived. A returned
+// error is sent to the client as a MsgError and stops further handling of
+// the message, including the built-in routing.
+type MessageHandler func(ctx *Context) error
+
+// Reply sends a message back to the socket the handled message came from,
+// referencing the handled message's ID in ReplyTo
+func (c *Context) Reply(msg Message) {
+	c.replied = true
+	c.Socket.Reply(c.Message, msg)
+}
+
+// ReplyEvent sends an event back to the socket the handled message came from
+func (c *Context) ReplyEvent(event string, data interface{}) {
+	c.Reply(Message{T: c.Socket.hub.MessageTypeCode(event), Data: data})
+}
+
+// ack answers a message that asked for an ack with a MsgAck carrying data
+func (c *Context) ack(data interface{}) {
+	if c.Message.Ack {
+		c.Reply(Message{T: MsgAck, Data: data})
+	}
+}
+
+// replyError sends a MsgError for a failed message back to its socket
+func (c *Context) replyError(err error) {
+	c.Reply(errorMessage(err, c.Event))
+}
+
+// OnEvent registers a handler for messages of one type, by its registered
+// name, e.g. "broadcast" or "offer"
+func (h *Hub) OnEvent(event string, handler MessageHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messageHandlers[event] = append(h.messageHandlers[event], handler)
+}
+
+// OnMessage registers a handler for every decoded message. It runs before
+// the handlers registered with OnEvent.
+func (h *Hub) OnMessage(handler MessageHandler) {
+	h.OnEvent("message", handler)
+}
+
+// runHandlers runs the message handlers for an inbound message, stopping at
+// the first error. It reports whether any handler was registered for the
+// message's type.
+func (h *Hub) runHandlers(ctx *Context) (bool, error) {
+	h.mu.RLock()
+	handlers := make([]MessageHandler, 0, len(h.messageHandlers["message"])+len(h.messageHandlers[ctx.Event]))
+	handlers = append(handlers, h.messageHandlers["message"]...)
+	handlers = append(handlers, h.messageHandlers[ctx.Event]...)
+	handled := len(h.messageHandlers[ctx.Event]) > 0
+	h.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx); err != nil {
+			return handled, err
+		}
+	}
+	return handled, nil
+}
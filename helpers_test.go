@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// connPair returns a client and a server connection joined by an in-memory
+// pipe. Writes block until the other side reads.
+func connPair() (client, server *Connection) {
+	a, b := net.Pipe()
+	client = &Connection{isClient: true, conn: a, reader: bufio.NewReader(a), writer: bufio.NewWriter(a)}
+	server = &Connection{conn: b, reader: bufio.NewReader(b), writer: bufio.NewWriter(b)}
+	return client, server
+}
+
+// testSocket adds a socket to the hub whose messages are queued but never
+// written
+func testSocket(h *Hub) *Socket {
+	return h.NewSocket(&Connection{
+		codec:       JSONCodec{},
+		writeChan:   make(chan outboundMessage, 64),
+		controlChan: make(chan outboundMessage, controlQueueSize),
+		closeChan:   make(chan bool),
+	})
+}
+
+// sentMessages drains the messages queued for a test socket
+func sentMessages(t *testing.T, socket *Socket) []Message {
+	t.Helper()
+	var msgs []Message
+	for {
+		select {
+		case out := <-socket.conn.writeChan:
+			data := out.data
+			if out.prepared != nil {
+				var err error
+				if _, data, err = out.prepared.payload(socket.conn); err != nil {
+					t.Fatal(err)
+				}
+			}
+			msg, err := socket.conn.messageCodec().Decode(data)
+			if err != nil {
+				t.Fatalf("undecodable message %q: %v", data, err)
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
@@ -1,8 +1,7 @@
 package ws
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"log"
 	"sync"
 	"time"
@@ -17,18 +16,48 @@ type Socket struct {
 	isBanned    bool
 	pendingFile *Message
 	alias       string
+	identity    *Identity
+	ctx         context.Context
+	cancel      context.CancelFunc
+	rooms       map[roomKey]struct{}
+	topics      map[string]struct{}
+	pending     map[string]chan Message // requests awaiting a reply, by ID
+	closeCode   int
+	closeReason string
 	mu          sync.RWMutex
 }
 
 // Hub manages all WebSocket connections and event handlers
 type Hub struct {
 	sockets        map[string]*Socket
+	users          map[string]map[string]*Socket // user ID -> socket ID -> socket
 	handlers       map[string][]Handler
 	globalHandlers map[string][]Handler
-	mu             sync.RWMutex
-	connCount      int64
-	maxConns       int64
-	storage        MessageStorage
+	// Handlers of decoded messages, by event name
+	messageHandlers map[string][]MessageHandler
+	// Middleware chains, guarded separately since messages are sent
+	// with the hub lock held
+	mwMu      sync.RWMutex
+	inbound   []Middleware
+	outbound  []OutboundMiddleware
+	mu        sync.RWMutex
+	connCount int64
+	maxConns  int64
+	storage   MessageStorage
+	ids       IDGenerator
+
+	// Namespaces of rooms, guarded separately so room fan-out does not
+	// hold the hub lock
+	nsMu       sync.RWMutex
+	namespaces map[string]*Namespace
+
+	// Topic subscriptions, matched with MQTT-style wildcards
+	topics       *topicTree
+	globalTopics map[string]bool
+
+	// Message types known to this hub, the built-in ones and those
+	// registered by the application
+	types *typeRegistry
 }
 
 // Handler is a function type for event handlers
@@ -40,11 +69,18 @@ func NewHub(storage MessageStorage) *Hub {
 		storage = NewInMemoryMessageStorage(24 * time.Hour)
 	}
 	return &Hub{
-		sockets:        make(map[string]*Socket),
-		handlers:       make(map[string][]Handler),
-		globalHandlers: make(map[string][]Handler),
-		maxConns:       100000,
-		storage:        storage,
+		sockets:         make(map[string]*Socket),
+		users:           make(map[string]map[string]*Socket),
+		handlers:        make(map[string][]Handler),
+		globalHandlers:  make(map[string][]Handler),
+		messageHandlers: make(map[string][]MessageHandler),
+		maxConns:        100000,
+		storage:         storage,
+		ids:             UUIDv7Generator{},
+		namespaces:      make(map[string]*Namespace),
+		topics:          newTopicTree(),
+		types:           newTypeRegistry(),
+		globalTopics:    map[string]bool{"general": true},
 	}
 }
 
@@ -59,17 +95,30 @@ func (h *Hub) NewSocket(conn *Connection) *Socket {
 
 	if h.connCount >= h.maxConns {
 		log.Println("Connection limit reached, rejecting connection")
+		conn.writeClose(CloseTryAgainLater, "connection limit reached")
 		conn.conn.Close()
 		return nil
 	}
 
-	socketID := generateSocketID()
+	socketID := h.ids.NewID()
+	ctx, cancel := context.WithCancel(context.Background())
 	socket := &Socket{
 		ID:         socketID,
 		conn:       conn,
 		hub:        h,
 		properties: make(map[string]interface{}),
+		rooms:      make(map[roomKey]struct{}),
+		topics:     make(map[string]struct{}),
 		isBanned:   false,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	conn.socket = socket
+	conn.backpressure.onSlow = func() {
+		log.Printf("Socket %s send queue is full (policy %s)", socketID, BackpressurePolicy(conn.backpressure.policy.Load()))
+		// Senders may hold hub locks, so slow handlers run on their own
+		go h.triggerHandlers("slow", socket)
 	}
 
 	h.sockets[socketID] = socket
@@ -78,11 +127,6 @@ func (h *Hub) NewSocket(conn *Connection) *Socket {
 	return socket
 }
 
-// generateSocketID generates a unique socket ID
-func generateSocketID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
-
 // Hub methods
 
 // On registers a global event handler
@@ -101,11 +145,6 @@ func (h *Hub) OnConnect(handler Handler) {
 	h.On("connect", handler)
 }
 
-// OnMessage registers a handler for messages
-func (h *Hub) OnMessage(handler Handler) {
-	h.On("message", handler)
-}
-
 // OnClose registers a handler for connection closes
 func (h *Hub) OnClose(handler Handler) {
 	h.On("close", handler)
@@ -123,29 +162,18 @@ func (h *Hub) Broadcast(event string, data interface{}) {
 
 // BroadcastExcept sends a message to all connected sockets except the specified sender
 func (h *Hub) BroadcastExcept(event string, data interface{}, excludeSocket *Socket) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
 	// Create unified message
-	msgType := stringToMsgType(event)
+	msgType := h.MessageTypeCode(event)
 	msg := Message{
 		T:    msgType,
 		Data: data,
 	}
 
-	if jsonData, err := json.Marshal(msg); err == nil {
-		sentCount := 0
-		for _, socket := range h.sockets {
-			if !socket.IsBanned() && socket != excludeSocket {
-				socket.conn.writeAsync(jsonData)
-				sentCount++
-			}
-		}
-		if excludeSocket != nil {
-			log.Printf("Broadcasting type %d to %d clients (excluding sender)", msgType, sentCount)
-		} else {
-			log.Printf("Broadcasting type %d to %d clients", msgType, sentCount)
-		}
+	sentCount := sendAll(h.recipients(excludeSocket), PrepareMessage(msg))
+	if excludeSocket != nil {
+		log.Printf("Broadcasting type %d to %d clients (excluding sender)", msgType, sentCount)
+	} else {
+		log.Printf("Broadcasting type %d to %d clients", msgType, sentCount)
 	}
 }
 
@@ -154,43 +182,63 @@ func (h *Hub) BroadcastMessage(msg Message) {
 	h.BroadcastMessageExcept(msg, nil)
 }
 
-// BroadcastMessageExcept sends a unified Message excluding the sender
+// BroadcastMessageExcept sends a unified Message excluding the sender. A
+// message on a topic that is not global goes to the sockets subscribed to a
+// matching filter instead, including the sender if subscribed.
 func (h *Hub) BroadcastMessageExcept(msg Message, excludeSocket *Socket) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	h.broadcastMessageExcept(msg, excludeSocket)
+}
 
-	if jsonData, err := json.Marshal(msg); err == nil {
-		sentCount := 0
-		for _, socket := range h.sockets {
-			if !socket.IsBanned() {
-				// If this is a topic message, only send to subscribers (including sender if subscribed)
-				if msg.Topic != "" && msg.Topic != "general" {
-					if !socket.conn.IsSubscribed(msg.Topic) {
-						continue // Skip this client if not subscribed to the topic
-					}
-				} else if socket == excludeSocket {
-					// For non-topic messages, exclude the sender
-					continue
-				}
-				socket.conn.writeAsync(jsonData)
-				sentCount++
-			}
-		}
+// broadcastMessageExcept is BroadcastMessageExcept returning the number of
+// recipients
+func (h *Hub) broadcastMessageExcept(msg Message, excludeSocket *Socket) int {
+	if msg.Topic != "" && !h.isGlobalTopic(msg.Topic) {
+		return h.publish(msg.Topic, PrepareMessage(msg))
 	}
+
+	return sendAll(h.recipients(excludeSocket), PrepareMessage(msg))
 }
 
-// BroadcastBinary sends binary data to all connected sockets except the sender
-func (h *Hub) BroadcastBinary(data []byte, excludeSocket *Socket) {
+// recipients returns the sockets a broadcast goes to. Sends happen after the
+// hub lock is released, since a blocking backpressure policy may wait on
+// each slow socket.
+func (h *Hub) recipients(excludeSocket *Socket) []*Socket {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	sentCount := 0
+	sockets := make([]*Socket, 0, len(h.sockets))
 	for _, socket := range h.sockets {
-		if !socket.IsBanned() && socket != excludeSocket {
-			socket.conn.writeBinaryAsync(data)
-			sentCount++
+		if socket != excludeSocket && !socket.IsBanned() {
+			sockets = append(sockets, socket)
 		}
 	}
+	return sockets
+}
+
+// sendAll queues a prepared message on each socket and returns the count.
+// Sockets that would wait under BlockWithTimeout because their queue is
+// full are sent to in parallel, so a fan-out is delayed by at most one
+// block timeout however many sockets are slow.
+func sendAll(sockets []*Socket, prepared *PreparedMessage) int {
+	var blocked sync.WaitGroup
+	for _, socket := range sockets {
+		if socket.conn.blocks() {
+			blocked.Add(1)
+			go func() {
+				defer blocked.Done()
+				socket.SendPrepared(prepared)
+			}()
+			continue
+		}
+		socket.SendPrepared(prepared)
+	}
+	blocked.Wait()
+	return len(sockets)
+}
+
+// BroadcastBinary sends binary data to all connected sockets except the sender
+func (h *Hub) BroadcastBinary(data []byte, excludeSocket *Socket) {
+	sentCount := sendAll(h.recipients(excludeSocket), prepareFileData(data))
 	if excludeSocket != nil {
 		log.Printf("Broadcasting binary data to %d clients (excluding sender)", sentCount)
 	} else {
@@ -200,72 +248,51 @@ func (h *Hub) BroadcastBinary(data []byte, excludeSocket *Socket) {
 
 // BroadcastBinaryToAll sends binary data to all connected sockets including the sender
 func (h *Hub) BroadcastBinaryToAll(data []byte) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	sentCount := 0
-	for _, socket := range h.sockets {
-		if !socket.IsBanned() {
-			socket.conn.writeBinaryAsync(data)
-			sentCount++
-		}
-	}
+	sentCount := sendAll(h.recipients(nil), prepareFileData(data))
 	log.Printf("Broadcasting binary data to %d clients (including sender)", sentCount)
 }
 
 // Notify sends a message to specific sockets
 func (h *Hub) Notify(socketIDs []string, event string, data interface{}) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
 	message := Message{
-		T:    stringToMsgType(event),
+		T:    h.MessageTypeCode(event),
 		Data: data,
 	}
 
-	if jsonData, err := json.Marshal(message); err == nil {
-		for _, socketID := range socketIDs {
-			if socket, exists := h.sockets[socketID]; exists && !socket.IsBanned() {
-				socket.conn.writeAsync(jsonData)
-			}
+	h.mu.RLock()
+	sockets := make([]*Socket, 0, len(socketIDs))
+	for _, socketID := range socketIDs {
+		if socket, exists := h.sockets[socketID]; exists && !socket.IsBanned() {
+			sockets = append(sockets, socket)
 		}
 	}
+	h.mu.RUnlock()
+
+	sendAll(sockets, PrepareMessage(message))
 }
 
-// Emit sends a message to a single socket
+// Emit sends a message to a single socket. A recipient that is not a
+// connected socket ID is taken as a user ID: the message goes to all of the
+// user's sockets, or is stored until their next connection.
 func (h *Hub) Emit(socketID string, event string, data interface{}) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	if socket, exists := h.sockets[socketID]; exists {
+	if socket := h.GetSocket(socketID); socket != nil {
 		socket.Send(event, data)
 	} else {
-		// Client is offline, store the message
-		msgType := stringToMsgType(event)
-		message := Message{
-			T:    msgType,
+		h.emitToUser(socketID, Message{
+			T:    h.MessageTypeCode(event),
 			Data: data,
-			ID:   generateMessageID(),
-		}
-		h.storage.StoreMessage(socketID, message)
+		})
 	}
 }
 
-// EmitBinary sends binary data to a single socket
+// EmitBinary sends binary data to a single socket, or to a user as for Emit
 func (h *Hub) EmitBinary(socketID string, data []byte) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	if socket, exists := h.sockets[socketID]; exists && !socket.IsBanned() {
-		socket.conn.writeBinaryAsync(data)
-	} else {
-		// Client is offline, store the binary message
-		message := Message{
-			T:    MsgFile,
-			Data: data,
-			ID:   generateMessageID(),
+	if socket := h.GetSocket(socketID); socket != nil {
+		if !socket.IsBanned() {
+			socket.sendBinary(data)
 		}
-		h.storage.StoreMessage(socketID, message)
+	} else {
+		h.emitBinaryToUser(socketID, data)
 	}
 }
 
@@ -302,9 +329,16 @@ func (h *Hub) GetSocketsByProperty(key string, value interface{}) []*Socket {
 	return matchingSockets
 }
 
-// DeliverOfflineMessages sends stored messages to a newly connected socket
+// DeliverOfflineMessages sends stored messages to a newly connected socket.
+// Messages are stored per user, so those queued while a user was offline go
+// to whichever of their devices connects first; anonymous sockets only get
+// messages stored under their socket ID.
 func (h *Hub) DeliverOfflineMessages(socket *Socket) error {
-	messages, err := h.storage.GetMessages(socket.ID)
+	recipient := socket.UserID()
+	if recipient == "" {
+		recipient = socket.ID
+	}
+	messages, err := h.storage.GetMessages(recipient)
 	if err != nil {
 		return err
 	}
@@ -330,21 +364,29 @@ func (h *Hub) DeliverOfflineMessages(socket *Socket) error {
 
 	// Delete delivered messages
 	if len(messageIDs) > 0 {
-		return h.storage.DeleteMessages(socket.ID, messageIDs)
+		return h.storage.DeleteMessages(recipient, messageIDs)
 	}
 
 	return nil
 }
 
-// RemoveSocket removes a socket from the hub
+// RemoveSocket removes a socket from the hub, its rooms and its topic
+// subscriptions
 func (h *Hub) RemoveSocket(socketID string) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if socket, exists := h.sockets[socketID]; exists {
+	socket, exists := h.sockets[socketID]
+	if exists {
 		delete(h.sockets, socketID)
+		h.unindexUser(socket, socket.UserID())
 		h.connCount--
+	}
+	h.mu.Unlock()
+
+	// Handlers run without the hub lock held
+	if exists {
 		h.triggerHandlers("disconnect", socket)
+		h.leaveAllRooms(socket)
+		h.unsubscribeAll(socket)
 	}
 }
 
@@ -376,42 +418,23 @@ func (h *Hub) GetConnectionCount() int64 {
 	return h.connCount
 }
 
-// GetAllTopics returns a list of all active topics across all connections
+// GetAllTopics returns a list of all topic filters with subscribers
 func (h *Hub) GetAllTopics() []string {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	topicSet := make(map[string]bool)
-	for _, socket := range h.sockets {
-		if !socket.IsBanned() {
-			subs := socket.conn.GetSubscriptions()
-			for topic := range subs {
-				topicSet[topic] = true
-			}
-		}
-	}
-
-	topics := make([]string, 0, len(topicSet))
-	for topic := range topicSet {
-		topics = append(topics, topic)
-	}
-	return topics
+	return h.topics.filters()
 }
 
-// triggerHandlers triggers all handlers for a specific event
+// triggerHandlers runs all handlers for a specific event in order, on the
+// calling goroutine
 func (h *Hub) triggerHandlers(event string, socket *Socket) {
-	// Trigger global handlers
-	if handlers, exists := h.globalHandlers[event]; exists {
-		for _, handler := range handlers {
-			go handler(socket)
-		}
-	}
-
-	// Trigger socket-specific handlers
-	if handlers, exists := h.handlers[socket.ID]; exists {
-		for _, handler := range handlers {
-			go handler(socket)
-		}
+	h.mu.RLock()
+	handlers := make([]Handler, 0, len(h.globalHandlers[event])+len(h.handlers[socket.ID]))
+	// Global handlers first, then socket-specific ones
+	handlers = append(handlers, h.globalHandlers[event]...)
+	handlers = append(handlers, h.handlers[socket.ID]...)
+	h.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(socket)
 	}
 }
 
@@ -452,12 +475,59 @@ func (s *Socket) GetProperty(key string) interface{} {
 	return s.properties[key]
 }
 
-// GetAlias returns the socket's alias
+// Context returns a context that is cancelled when the socket disconnects
+func (s *Socket) Context() context.Context {
+	return s.ctx
+}
+
+// Identity returns the authenticated user of the socket, or nil for an
+// anonymous connection
+func (s *Socket) Identity() *Identity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.identity
+}
+
+// SetIdentity attaches an authenticated user to the socket, e.g. after an
+// in-band login message, and indexes the socket under the user's ID. The
+// messages stored while the user was offline are delivered to the socket.
+func (s *Socket) SetIdentity(identity *Identity) {
+	if !s.setIdentity(identity) {
+		return
+	}
+	if err := s.hub.DeliverOfflineMessages(s); err != nil {
+		log.Printf("Error delivering offline messages to %s: %v", s.ID, err)
+	}
+}
+
+// setIdentity attaches identity to the socket, reporting whether the socket
+// was indexed under a new user ID
+func (s *Socket) setIdentity(identity *Identity) bool {
+	s.mu.Lock()
+	previous := s.identity
+	s.identity = identity
+	s.mu.Unlock()
+
+	if s.hub == nil {
+		return false
+	}
+	return s.hub.bindUser(s, userIDOf(previous), userIDOf(identity))
+}
+
+// UserID returns the user ID of the socket's identity, or an empty string
+// for an anonymous connection. A user may have several sockets, one per
+// device or tab.
+func (s *Socket) UserID() string {
+	return userIDOf(s.Identity())
+}
+
+// GetAlias returns the socket's alias, or an abbreviation of its ID if it
+// has none
 func (s *Socket) GetAlias() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.alias == "" {
-		return s.ID[:12] // Return first 12 chars of ID if no alias
+		return shortID(s.ID)
 	}
 	return s.alias
 }
@@ -481,18 +551,64 @@ func (h *Hub) GetUserList() []map[string]interface{} {
 				"id":    socket.ID,
 				"alias": socket.GetAlias(),
 			}
+			if userID := socket.UserID(); userID != "" {
+				user["user_id"] = userID
+			}
 			users = append(users, user)
 		}
 	}
 	return users
 }
 
+// RTT returns the round trip time measured from the last server ping, or 0
+// if no pong has been received yet
+func (s *Socket) RTT() time.Duration {
+	return s.conn.RTT()
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, or
+// an empty string if the client did not request one
+func (s *Socket) Subprotocol() string {
+	return s.conn.subprotocol
+}
+
 // GetID returns the socket ID
 func (s *Socket) GetID() string {
 	return s.ID
 }
 
-// Close closes the socket connection
+// Close closes the socket connection with a normal closure status
 func (s *Socket) Close() {
-	s.conn.conn.Close()
+	s.CloseWithCode(CloseNormalClosure, "")
+}
+
+// CloseWithCode starts the closing handshake by sending a close frame with
+// the given status code and reason. The TCP connection is torn down once the
+// client answers, or when the server's close timeout expires.
+func (s *Socket) CloseWithCode(code int, reason string) error {
+	return s.conn.closeWithTimeout(code, reason)
+}
+
+// setCloseStatus records why the connection closed
+func (s *Socket) setCloseStatus(code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCode = code
+	s.closeReason = reason
+}
+
+// CloseCode returns the close status code received from the client, or
+// CloseAbnormalClosure if the connection dropped without a close frame.
+// It is set by the time OnClose and OnDisconnect handlers run.
+func (s *Socket) CloseCode() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closeCode
+}
+
+// CloseReason returns the close reason received from the client
+func (s *Socket) CloseReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closeReason
 }
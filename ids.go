@@ -0,0 +1,121 @@
+package ws
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator creates the IDs of sockets, messages, stored messages and
+// threads. IDs must be unique and hard to guess; IDs that sort by creation
+// time let message history be paginated by ID.
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator
+type IDGeneratorFunc func() string
+
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// UUIDv7Generator generates version 7 UUIDs (RFC 9562): a millisecond
+// timestamp followed by random bits, in canonical lowercase form so they sort
+// by creation time. It is the hub's default generator.
+type UUIDv7Generator struct{}
+
+func (UUIDv7Generator) NewID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
+// ULIDGenerator generates ULIDs: 26 Crockford base32 characters encoding a
+// millisecond timestamp and 80 random bits. IDs generated within the same
+// millisecond increment the random part so they stay strictly ordered. The
+// zero value is ready to use.
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	entropy [10]byte
+}
+
+// crockford is the ULID alphabet, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ULIDGenerator) NewID() string {
+	g.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms > g.lastMs || !g.increment() {
+		if ms <= g.lastMs {
+			// The random part overflowed within one millisecond
+			ms = g.lastMs + 1
+		}
+		rand.Read(g.entropy[:])
+		g.lastMs = ms
+	}
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(g.lastMs >> (40 - 8*i))
+	}
+	copy(id[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	// Encode the 128 bits five at a time, from the least significant end
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(id[i])
+		lo = lo<<8 | uint64(id[8+i])
+	}
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// increment adds one to the random part, reporting false on overflow
+func (g *ULIDGenerator) increment() bool {
+	for i := len(g.entropy) - 1; i >= 0; i-- {
+		g.entropy[i]++
+		if g.entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIDGenerator replaces the generator of socket, message and thread IDs.
+// A storage with a SetIDGenerator method, such as InMemoryMessageStorage,
+// gets it too so stored messages use the same IDs. It should be called
+// before the hub accepts connections.
+func (h *Hub) SetIDGenerator(gen IDGenerator) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ids = gen
+	if storage, ok := h.storage.(interface{ SetIDGenerator(IDGenerator) }); ok {
+		storage.SetIDGenerator(gen)
+	}
+}
+
+// NewID returns a new ID from the hub's generator
+func (h *Hub) NewID() string {
+	return h.ids.NewID()
+}
+
+// shortID abbreviates an ID for display. The tail is used because UUIDv7
+// and ULID start with their timestamp, which sockets created in the same
+// millisecond share.
+func shortID(id string) string {
+	if len(id) <= 8 {
+		return id
+	}
+	return id[len(id)-8:]
+}
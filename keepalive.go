@@ -0,0 +1,124 @@
+package ws
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Keepalive defaults applied by NewServer
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// pingPayloadLen is the size of the timestamp carried in server pings
+const pingPayloadLen = 8
+
+// keepalive holds the ping/pong and deadline state of a connection
+type keepalive struct {
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// pongDeadline is set while a ping is unanswered; guarded by
+	// Connection.deadlineMu
+	pongDeadline time.Time
+
+	// rtt is the last measured round trip time in nanoseconds
+	rtt atomic.Int64
+
+	// In netpoll mode no read is pending while a connection is parked, so
+	// the poller enforces readDeadline and schedules pings itself; both are
+	// Unix nanoseconds and readDeadline is 0 when unset
+	readDeadline atomic.Int64
+	lastPing     atomic.Int64
+}
+
+// refreshReadDeadline pushes the read deadline forward after activity from
+// the peer. An outstanding ping caps the deadline at its pong timeout.
+func (c *Connection) refreshReadDeadline() {
+	if c.keepalive.idleTimeout <= 0 && c.keepalive.pongTimeout <= 0 {
+		return
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	var deadline time.Time
+	if c.keepalive.idleTimeout > 0 {
+		deadline = time.Now().Add(c.keepalive.idleTimeout)
+	}
+	if pong := c.keepalive.pongDeadline; !pong.IsZero() && (deadline.IsZero() || pong.Before(deadline)) {
+		deadline = pong
+	}
+	c.conn.SetReadDeadline(deadline)
+	if deadline.IsZero() {
+		c.keepalive.readDeadline.Store(0)
+	} else {
+		c.keepalive.readDeadline.Store(deadline.UnixNano())
+	}
+}
+
+// setWriteDeadline bounds the next write by the write timeout. The caller
+// must hold writeMu.
+func (c *Connection) setWriteDeadline() {
+	if c.keepalive.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.writeTimeout))
+	}
+}
+
+// sendPing sends a ping carrying the current time and arms the pong timeout
+func (c *Connection) sendPing() error {
+	now := time.Now()
+	var payload [pingPayloadLen]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+
+	if c.keepalive.pongTimeout > 0 {
+		c.deadlineMu.Lock()
+		if c.keepalive.pongDeadline.IsZero() {
+			c.keepalive.pongDeadline = now.Add(c.keepalive.pongTimeout)
+		}
+		c.deadlineMu.Unlock()
+		c.refreshReadDeadline()
+	}
+	return c.writeMessage(PingMessage, payload[:])
+}
+
+// handlePong records the round trip time of one of our pings and clears the
+// pong timeout
+func (c *Connection) handlePong(payload []byte) {
+	if len(payload) == pingPayloadLen {
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+		if rtt := time.Since(sent); rtt >= 0 {
+			c.keepalive.rtt.Store(int64(rtt))
+		}
+	}
+
+	c.deadlineMu.Lock()
+	c.keepalive.pongDeadline = time.Time{}
+	c.deadlineMu.Unlock()
+	c.refreshReadDeadline()
+}
+
+// RTT returns the round trip time measured by the last answered ping
+func (c *Connection) RTT() time.Duration {
+	return time.Duration(c.keepalive.rtt.Load())
+}
+
+// pollTick runs the keepalive of a connection parked in netpoll mode: it
+// queues a ping when one is due and aborts the connection once its read
+// deadline has passed
+func (c *Connection) pollTick(now time.Time) {
+	if deadline := c.keepalive.readDeadline.Load(); deadline != 0 && now.UnixNano() > deadline {
+		c.abort()
+		return
+	}
+	if interval := c.keepalive.pingInterval; interval > 0 {
+		if last := c.keepalive.lastPing.Load(); now.Sub(time.Unix(0, last)) >= interval {
+			c.keepalive.lastPing.Store(now.UnixNano())
+			c.writeControlAsync(PingMessage, nil)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package ws
 
 import (
-	"encoding/json"
+	"io"
 )
 
 // Message types (compact protocol)
@@ -37,6 +37,12 @@ const (
 	MsgCallStateChanged  = 28
 	MsgRecordingStarted  = 29
 	MsgRecordingFinished = 30
+	// Direct (one-to-one) call signaling types
+	MsgDirectCallInvite  = 31
+	MsgDirectCallAccept  = 32
+	MsgDirectCallReject  = 33
+	MsgDirectCallEnd     = 34
+	MsgDirectCallRinging = 35
 )
 
 // Message represents the unified message format
@@ -50,140 +56,7 @@ type Message struct {
 	ThreadID string      `json:"threadId,omitempty"` // Thread ID for threaded conversations
 	ReplyTo  string      `json:"replyTo,omitempty"`  // Message ID being replied to
 	From     string      `json:"from,omitempty"`     // Sender alias/username
-}
-
-// stringToMsgType converts string event names to numeric types
-func stringToMsgType(event string) int {
-	switch event {
-	case "broadcast":
-		return MsgBroadcast
-	case "private":
-		return MsgPrivate
-	case "system":
-		return MsgSystem
-	case "subscribed":
-		return MsgAck
-	case "unsubscribed":
-		return MsgAck
-	case "ping":
-		return MsgPing
-	case "pong":
-		return MsgPong
-	case "error":
-		return MsgError
-	case "file":
-		return MsgFile
-	case "typing":
-		return MsgTyping
-	case "direct":
-		return MsgDirect
-	case "thread":
-		return MsgThread
-	case "user_list":
-		return MsgUserList
-	case "set_alias":
-		return MsgSetAlias
-	case "auth":
-		return MsgAuth
-	case "join":
-		return MsgJoin
-	case "offer":
-		return MsgOffer
-	case "answer":
-		return MsgAnswer
-	case "ice-candidate":
-		return MsgIceCandidate
-	case "mute":
-		return MsgMute
-	case "unmute":
-		return MsgUnmute
-	case "hold":
-		return MsgHold
-	case "dtmf":
-		return MsgDTMF
-	case "joined":
-		return MsgJoined
-	case "peer-joined":
-		return MsgPeerJoined
-	case "peer-left":
-		return MsgPeerLeft
-	case "call-state-changed":
-		return MsgCallStateChanged
-	case "recording-started":
-		return MsgRecordingStarted
-	case "recording-finished":
-		return MsgRecordingFinished
-	default:
-		return MsgSystem // Default to system message
-	}
-}
-
-// msgTypeToString converts numeric message type to string
-func msgTypeToString(msgType int) string {
-	switch msgType {
-	case MsgBroadcast:
-		return "broadcast"
-	case MsgPrivate:
-		return "private"
-	case MsgSystem:
-		return "system"
-	case MsgSubscribe:
-		return "subscribe"
-	case MsgUnsubscribe:
-		return "unsubscribe"
-	case MsgPing:
-		return "ping"
-	case MsgPong:
-		return "pong"
-	case MsgError:
-		return "error"
-	case MsgAck:
-		return "ack"
-	case MsgFile:
-		return "file"
-	case MsgTyping:
-		return "typing"
-	case MsgDirect:
-		return "direct"
-	case MsgThread:
-		return "thread"
-	case MsgUserList:
-		return "user_list"
-	case MsgSetAlias:
-		return "set_alias"
-	case MsgAuth:
-		return "auth"
-	case MsgJoin:
-		return "join"
-	case MsgOffer:
-		return "offer"
-	case MsgAnswer:
-		return "answer"
-	case MsgIceCandidate:
-		return "ice-candidate"
-	case MsgMute:
-		return "mute"
-	case MsgUnmute:
-		return "unmute"
-	case MsgHold:
-		return "hold"
-	case MsgDTMF:
-		return "dtmf"
-	case MsgJoined:
-		return "joined"
-	case MsgPeerJoined:
-		return "peer-joined"
-	case MsgPeerLeft:
-		return "peer-left"
-	case MsgCallStateChanged:
-		return "call-state-changed"
-	case MsgRecordingStarted:
-		return "recording-started"
-	case MsgRecordingFinished:
-		return "recording-finished"
-	default:
-		return "unknown"
-	}
+	Ack      bool        `json:"ack,omitempty"`      // Request a MsgAck if handling produces no reply
 }
 
 // SendMessage sends a unified Message directly
@@ -191,9 +64,18 @@ func (s *Socket) SendMessage(msg Message) {
 	if s.isBanned {
 		return
 	}
-	if jsonData, err := json.Marshal(msg); err == nil {
-		s.conn.writeAsync(jsonData)
+	s.hub.sendOutbound(s, msg, s.writeMessage)
+}
+
+// writeMessage encodes a message with the socket's codec and queues it
+func (s *Socket) writeMessage(msg Message) error {
+	codec := s.conn.messageCodec()
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
 	}
+	s.conn.writeEncodedAsync(codec, data)
+	return nil
 }
 
 // Send sends a message to the socket using the unified format with a string event
@@ -203,19 +85,41 @@ func (s *Socket) Send(event string, data interface{}) {
 	}
 
 	// Convert string event to numeric type
-	msgType := stringToMsgType(event)
+	msgType := s.hub.MessageTypeCode(event)
 	m := Message{
 		T:    msgType,
 		Data: data,
 		ID:   s.ID,
 	}
+	s.hub.sendOutbound(s, m, s.writeMessage)
+}
 
-	if jsonData, err := json.Marshal(m); err == nil {
-		s.conn.writeAsync(jsonData)
+// sendBinary queues raw binary data such as a file payload. Connections with
+// a binary codec reserve binary frames for messages, so the data is wrapped
+// in a MsgFile message there.
+func (s *Socket) sendBinary(data []byte) {
+	codec := s.conn.messageCodec()
+	if !isBinaryCodec(codec) {
+		s.conn.writeBinaryAsync(data)
+		return
 	}
+	s.SendMessage(Message{
+		T:    MsgFile,
+		Data: map[string]interface{}{FileContentKey: data},
+	})
 }
 
 // Emit emits a custom event to the socket
 func (s *Socket) Emit(event string, data interface{}) {
 	s.Send(event, data)
 }
+
+// SendStream streams everything read from r to the socket as a single
+// fragmented binary message. It writes synchronously and returns once the
+// final fragment has been flushed.
+func (s *Socket) SendStream(r io.Reader) error {
+	if s.IsBanned() {
+		return nil
+	}
+	return s.conn.writeStream(BinaryMessage, r)
+}
@@ -2,6 +2,8 @@ package ws
 
 import (
 	"database/sql"
+	"encoding/json"
+	"reflect"
 	"time"
 
 	"github.com/google/uuid"
@@ -38,41 +40,95 @@ type SignalingMessage struct {
 	Payload interface{} `json:"payload"`
 }
 
-// AuthPayload for auth messages
+// AuthPayload for auth messages. The token may be omitted by sockets
+// authenticated during the handshake.
 type AuthPayload struct {
 	Token string `json:"token"`
 }
 
 // JoinPayload for join messages
 type JoinPayload struct {
-	Room         string                 `json:"room"`
+	Room         string                 `json:"room" validate:"required"`
 	DisplayName  string                 `json:"display_name"`
 	Capabilities map[string]interface{} `json:"capabilities"`
 }
 
 // SDPPayload for offer/answer messages
 type SDPPayload struct {
-	SDP    string    `json:"sdp"`
-	CallID uuid.UUID `json:"call_id"`
+	SDP    string  `json:"sdp" validate:"required"`
+	CallID CallRef `json:"call_id"`
 }
 
 // ICEPayload for ice-candidate messages
 type ICEPayload struct {
-	Candidate     string `json:"candidate"`
+	Candidate     string `json:"candidate" validate:"required"`
 	SDPMid        string `json:"sdpMid"`
 	SDPMLineIndex int    `json:"sdpMLineIndex"`
 }
 
 // ControlPayload for mute/unmute/hold messages
 type ControlPayload struct {
-	CallID uuid.UUID `json:"call_id"`
-	Track  string    `json:"track,omitempty"`
+	CallID CallRef `json:"call_id"`
+	Track  string  `json:"track,omitempty"`
 }
 
 // DTMFPayload for dtmf messages
 type DTMFPayload struct {
-	CallID uuid.UUID `json:"call_id"`
-	Tones  string    `json:"tones"`
+	CallID CallRef `json:"call_id"`
+	Tones  string  `json:"tones" validate:"required"`
+}
+
+// CallRef is the call_id of a signaling payload. Clients may send any
+// string, e.g. the room ID: a UUID is decoded into UUID and anything else
+// is kept in Ref. It is encoded back as the string it was sent as, by the
+// JSON and the binary codecs alike.
+type CallRef struct {
+	UUID uuid.UUID
+	Ref  string
+}
+
+// NewCallRef returns the CallRef of a call_id string
+func NewCallRef(s string) CallRef {
+	if id, err := uuid.Parse(s); err == nil {
+		return CallRef{UUID: id}
+	}
+	return CallRef{Ref: s}
+}
+
+// String returns call_id as sent: Ref if set, else the UUID, or "" if
+// neither is
+func (c CallRef) String() string {
+	switch {
+	case c.Ref != "":
+		return c.Ref
+	case c.UUID != uuid.Nil:
+		return c.UUID.String()
+	}
+	return ""
+}
+
+// MarshalJSON encodes the call reference as a string
+func (c CallRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// UnmarshalJSON decodes a call_id string. null is the zero CallRef.
+func (c *CallRef) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*c = CallRef{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &json.UnmarshalTypeError{Value: "call_id", Type: reflect.TypeOf(s), Field: "call_id"}
+	}
+	*c = NewCallRef(s)
+	return nil
+}
+
+// AliasPayload for set_alias messages
+type AliasPayload struct {
+	Alias string `json:"alias" validate:"required"`
 }
 
 // RoomState represents the current state of a room
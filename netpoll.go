@@ -0,0 +1,231 @@
+package ws
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrNetpollUnsupported is returned by EnableNetpoll on platforms without
+// epoll
+var ErrNetpollUnsupported = errors.New("websocket: netpoll mode is only supported on linux")
+
+// Netpoll timing: how often the poller checks for shutdown and how often it
+// runs the keepalive of parked connections
+const (
+	pollWaitTimeout  = 100 * time.Millisecond
+	pollTickInterval = time.Second
+)
+
+// bufferSize is the size of pooled bufio readers and writers, matching the
+// bufio default used in goroutine mode
+const bufferSize = 4096
+
+var (
+	readerPool = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, bufferSize) }}
+	writerPool = sync.Pool{New: func() any { return bufio.NewWriterSize(nil, bufferSize) }}
+)
+
+// EnableNetpoll switches the server to netpoll mode. Instead of a reader and
+// a writer goroutine with their own buffers per connection, idle connections
+// are parked in an epoll set: a goroutine and a pooled read buffer are only
+// taken while a connection is readable, and a writer goroutine with a pooled
+// write buffer only while its send queue is non-empty. Pings and timeouts of
+// parked connections are driven by the poller. Connections without a file
+// descriptor, such as TLS connections, keep using goroutine mode.
+//
+// Netpoll mode is only available on Linux; elsewhere ErrNetpollUnsupported is
+// returned and the server stays in goroutine mode. Applies to connections
+// accepted after the call.
+func (s *Server) EnableNetpoll() error {
+	p, err := newPoller(s.serveReadable, s.pollTick)
+	if err != nil {
+		return err
+	}
+	s.poller = p
+	return nil
+}
+
+// startNetpoll parks a freshly upgraded connection in the poller
+func (s *Server) startNetpoll(socket *Socket) {
+	socket.conn.keepalive.lastPing.Store(time.Now().UnixNano())
+
+	// The registration keeps the WaitGroup count up until the connection
+	// is torn down, so readable goroutines can be tracked
+	s.wg.Add(1)
+	if err := s.poller.add(socket); err != nil {
+		log.Printf("Netpoll registration failed for %s: %v", socket.ID, err)
+		s.wg.Done()
+		socket.setCloseStatus(CloseAbnormalClosure, "")
+		s.finishConnection(socket)
+	}
+}
+
+// serveReadable is called by the poller when a parked connection becomes
+// readable. It handles every message already received, then parks the
+// connection again.
+func (s *Server) serveReadable(socket *Socket) {
+	s.goTracked(func() {
+		c := socket.conn
+		// The one-shot event already ensures a single reader; the lock
+		// orders reader state between successive goroutines
+		c.readMu.Lock()
+		defer c.readMu.Unlock()
+		c.acquireReader()
+		for {
+			opcode, payload, err := c.readMessage()
+			if err == nil && isControl(opcode) {
+				err = c.handleControl(opcode, payload)
+			}
+			if err != nil {
+				c.releaseReader()
+				s.handleReadError(socket, err)
+				s.finishNetpoll(socket)
+				return
+			}
+			if !isControl(opcode) {
+				s.dispatch(socket, int(opcode), payload)
+			}
+			if c.reader.Buffered() == 0 {
+				break
+			}
+		}
+		c.releaseReader()
+
+		if err := s.poller.rearm(socket); err != nil {
+			log.Printf("Netpoll rearm failed for %s: %v", socket.ID, err)
+			s.handleReadError(socket, err)
+			s.finishNetpoll(socket)
+		}
+	})
+}
+
+// finishNetpoll removes a connection from the poller and tears it down
+func (s *Server) finishNetpoll(socket *Socket) {
+	s.poller.remove(socket)
+	s.finishConnection(socket)
+	s.wg.Done()
+}
+
+// pollTick runs the keepalive of every polled connection
+func (s *Server) pollTick(now time.Time) {
+	for _, socket := range s.hub.GetAllSockets() {
+		if socket.conn.pooled {
+			socket.conn.pollTick(now)
+		}
+	}
+}
+
+// acquireReader borrows a pooled read buffer in netpoll mode
+func (c *Connection) acquireReader() {
+	if c.reader == nil {
+		r := readerPool.Get().(*bufio.Reader)
+		r.Reset(c.conn)
+		c.reader = r
+	}
+}
+
+// releaseReader returns the read buffer to the pool once it holds no
+// unread bytes
+func (c *Connection) releaseReader() {
+	if c.pooled && c.reader != nil && c.reader.Buffered() == 0 {
+		c.reader.Reset(nil)
+		readerPool.Put(c.reader)
+		c.reader = nil
+	}
+}
+
+// lockWrite acquires writeMu and, in netpoll mode, a pooled write buffer
+func (c *Connection) lockWrite() {
+	c.writeMu.Lock()
+	if c.writer == nil {
+		w := writerPool.Get().(*bufio.Writer)
+		w.Reset(c.conn)
+		c.writer = w
+	}
+}
+
+// unlockWrite returns a flushed pooled write buffer and releases writeMu
+func (c *Connection) unlockWrite() {
+	if c.pooled && c.writer != nil && c.writer.Buffered() == 0 {
+		c.writer.Reset(nil)
+		writerPool.Put(c.writer)
+		c.writer = nil
+	}
+	c.writeMu.Unlock()
+}
+
+// wakeWriter starts a goroutine draining the send queues in netpoll mode,
+// unless one is already running. The goroutine is added to writers so
+// Shutdown waits for queued messages to be written.
+func (c *Connection) wakeWriter() {
+	if c.pooled && c.writerActive.CompareAndSwap(false, true) {
+		if c.writers == nil {
+			go c.drainQueues()
+			return
+		}
+		c.writers.Add(1)
+		go func() {
+			defer c.writers.Done()
+			c.drainQueues()
+		}()
+	}
+}
+
+// drainQueues writes queued messages until the queues are empty
+func (c *Connection) drainQueues() {
+	for {
+		for c.writeNext() {
+		}
+		select {
+		case <-c.closeChan:
+			return
+		default:
+		}
+		c.writerActive.Store(false)
+		// A message queued after the last writeNext found nothing would
+		// otherwise wait for the next wakeup
+		if len(c.controlChan)+len(c.writeChan) == 0 || !c.writerActive.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// writeNext writes one queued message, control frames first. It reports
+// false when the queues are empty or the connection is closed.
+func (c *Connection) writeNext() bool {
+	select {
+	case <-c.closeChan:
+		return false
+	case msg := <-c.controlChan:
+		c.writeOutbound(msg)
+		return true
+	default:
+	}
+
+	select {
+	case msg := <-c.writeChan:
+		if msg.messageType == 0 && msg.prepared == nil {
+			return false
+		}
+		c.writeOutbound(msg)
+		c.clearSlow()
+		return true
+	default:
+		return false
+	}
+}
+
+// abort drops the connection without a closing handshake. In netpoll mode
+// only the read side is shut down: the poller then wakes a reader, which
+// runs the usual teardown.
+func (c *Connection) abort() {
+	if cr, ok := c.conn.(interface{ CloseRead() error }); ok && c.pooled {
+		if cr.CloseRead() == nil {
+			return
+		}
+	}
+	c.conn.Close()
+}
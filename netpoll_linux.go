@@ -0,0 +1,145 @@
+//go:build linux
+
+package ws
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// pollEvents arms a connection for a single readable or hang-up event; it is
+// re-armed once the messages received so far have been handled
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller parks idle connections in an epoll set
+type poller struct {
+	epfd       int
+	onReadable func(*Socket)
+	onTick     func(time.Time)
+
+	mu      sync.RWMutex
+	sockets map[int]*Socket
+
+	closed atomic.Bool
+	done   chan struct{}
+}
+
+// newPoller creates an epoll set and starts waiting on it
+func newPoller(onReadable func(*Socket), onTick func(time.Time)) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{
+		epfd:       epfd,
+		onReadable: onReadable,
+		onTick:     onTick,
+		sockets:    make(map[int]*Socket),
+		done:       make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// run dispatches readable connections and drives the keepalive tick until
+// the poller is closed
+func (p *poller) run() {
+	defer close(p.done)
+
+	events := make([]syscall.EpollEvent, 256)
+	nextTick := time.Now().Add(pollTickInterval)
+	for !p.closed.Load() {
+		n, err := syscall.EpollWait(p.epfd, events, int(pollWaitTimeout/time.Millisecond))
+		if err != nil && err != syscall.EINTR {
+			log.Printf("Netpoll wait failed: %v", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mu.RLock()
+			socket := p.sockets[int(events[i].Fd)]
+			p.mu.RUnlock()
+			if socket != nil {
+				p.onReadable(socket)
+			}
+		}
+
+		if now := time.Now(); !now.Before(nextTick) {
+			p.onTick(now)
+			nextTick = now.Add(pollTickInterval)
+		}
+	}
+}
+
+// canPoll reports whether conn exposes a file descriptor
+func (p *poller) canPoll(conn net.Conn) bool {
+	_, ok := conn.(syscall.Conn)
+	return ok
+}
+
+// connFD returns the file descriptor of a connection
+func connFD(conn net.Conn) (int, error) {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// add parks a connection until it becomes readable
+func (p *poller) add(socket *Socket) error {
+	fd, err := connFD(socket.conn.conn)
+	if err != nil {
+		return err
+	}
+	socket.conn.pollFD = fd
+
+	p.mu.Lock()
+	p.sockets[fd] = socket
+	p.mu.Unlock()
+
+	event := syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		p.mu.Lock()
+		delete(p.sockets, fd)
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rearm parks a connection again after its messages have been handled
+func (p *poller) rearm(socket *Socket) error {
+	event := syscall.EpollEvent{Events: pollEvents, Fd: int32(socket.conn.pollFD)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, socket.conn.pollFD, &event)
+}
+
+// remove forgets a connection. It must be called before the connection is
+// closed, as the descriptor may be reused right after.
+func (p *poller) remove(socket *Socket) {
+	fd := socket.conn.pollFD
+	p.mu.Lock()
+	delete(p.sockets, fd)
+	p.mu.Unlock()
+	// Connections aborted by a timed-out Shutdown may be removed after the
+	// epoll descriptor has been closed and possibly reused
+	if !p.closed.Load() {
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	}
+}
+
+// close stops the poller
+func (p *poller) close() error {
+	if !p.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	<-p.done
+	return syscall.Close(p.epfd)
+}
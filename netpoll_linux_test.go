@@ -0,0 +1,48 @@
+package ws
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesPoller(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending bool
+		wantErr error
+	}{
+		{"connections drained", false, nil},
+		{"context expired", true, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		s := NewServer()
+		if err := s.EnableNetpoll(); err != nil {
+			t.Fatal(err)
+		}
+		p := s.poller
+		if tt.pending {
+			// A connection goroutine that never exits
+			s.wg.Add(1)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := s.Shutdown(ctx)
+		cancel()
+		if err != tt.wantErr {
+			t.Errorf("%s: Shutdown = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		select {
+		case <-p.done:
+		default:
+			t.Errorf("%s: poller goroutine still running", tt.name)
+		}
+		if _, err := syscall.EpollWait(p.epfd, make([]syscall.EpollEvent, 1), 0); err != syscall.EBADF {
+			t.Errorf("%s: epoll descriptor still open: %v", tt.name, err)
+		}
+		if tt.pending {
+			s.wg.Done()
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package ws
+
+import (
+	"net"
+	"time"
+)
+
+// poller is unavailable without epoll; EnableNetpoll never installs one
+type poller struct{}
+
+func newPoller(onReadable func(*Socket), onTick func(time.Time)) (*poller, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *poller) canPoll(conn net.Conn) bool { return false }
+
+func (p *poller) add(socket *Socket) error { return ErrNetpollUnsupported }
+
+func (p *poller) rearm(socket *Socket) error { return ErrNetpollUnsupported }
+
+func (p *poller) remove(socket *Socket) {}
+
+func (p *poller) close() error { return nil }
@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPooledWriterTracked(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+	}{
+		{"single message", 1},
+		{"several messages", 5},
+	}
+	for _, tt := range tests {
+		client, server := connPair()
+		var wg sync.WaitGroup
+		server.pooled = true
+		server.writer = nil
+		server.writers = &wg
+		server.writeChan = make(chan outboundMessage, tt.messages)
+		server.controlChan = make(chan outboundMessage, controlQueueSize)
+		server.closeChan = make(chan bool)
+		for i := 0; i < tt.messages; i++ {
+			server.writeChan <- outboundMessage{messageType: TextMessage, data: []byte("queued")}
+		}
+		server.wakeWriter()
+
+		// The writer is blocked on the pipe until the client reads, so the
+		// WaitGroup must not be released yet
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatalf("%s: WaitGroup released while messages were pending", tt.name)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		for i := 0; i < tt.messages; i++ {
+			if _, payload, err := client.readMessage(); err != nil || string(payload) != "queued" {
+				t.Fatalf("%s: message %d: got %q, %v", tt.name, i, payload, err)
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: writer did not finish after the queue drained", tt.name)
+		}
+	}
+}
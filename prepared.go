@@ -0,0 +1,217 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"sync"
+)
+
+// PreparedMessage is a message that is encoded and framed at most once per
+// distinct connection configuration, so a broadcast to many sockets writes
+// the same bytes to each of them instead of re-encoding and re-framing per
+// recipient. It is safe for concurrent use.
+type PreparedMessage struct {
+	messageType int
+	msg         *Message
+	data        []byte
+	file        bool
+
+	mu       sync.Mutex
+	payloads map[string]preparedPayload
+	frames   map[preparedKey][]byte
+}
+
+// preparedPayload is a message encoded for one subprotocol
+type preparedPayload struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// preparedKey identifies the connection settings that change the framed
+// bytes of a message
+type preparedKey struct {
+	subprotocol  string
+	compressed   bool
+	level        int
+	fragmentSize int
+}
+
+// NewPreparedMessage prepares raw data to be sent as a text or binary message
+func NewPreparedMessage(messageType int, data []byte) *PreparedMessage {
+	return &PreparedMessage{messageType: messageType, data: data}
+}
+
+// PrepareMessage prepares a unified Message. It is encoded with the codec of
+// each recipient's subprotocol.
+func PrepareMessage(msg Message) *PreparedMessage {
+	return &PreparedMessage{msg: &msg}
+}
+
+// prepareFileData prepares raw binary data such as a file payload. Sockets
+// with a binary codec receive it wrapped in a MsgFile message, see sendBinary.
+func prepareFileData(data []byte) *PreparedMessage {
+	return &PreparedMessage{messageType: BinaryMessage, data: data, file: true}
+}
+
+// payload returns the message encoded for the connection's subprotocol
+func (pm *PreparedMessage) payload(c *Connection) (int, []byte, error) {
+	if pm.msg == nil && !(pm.file && isBinaryCodec(c.messageCodec())) {
+		return pm.messageType, pm.data, nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if p, ok := pm.payloads[c.subprotocol]; ok {
+		return p.messageType, p.data, p.err
+	}
+
+	codec := c.messageCodec()
+	msg := pm.msg
+	if msg == nil {
+		msg = &Message{
+			T:    MsgFile,
+			Data: map[string]interface{}{FileContentKey: pm.data},
+		}
+	}
+	data, err := codec.Encode(*msg)
+	p := preparedPayload{messageType: codec.MessageType(), data: data, err: err}
+	if pm.payloads == nil {
+		pm.payloads = make(map[string]preparedPayload, 1)
+	}
+	pm.payloads[c.subprotocol] = p
+	return p.messageType, p.data, p.err
+}
+
+// frame returns the message fully framed for the connection. ok is false
+// when the frames depend on per-connection state: client frames are masked
+// with a fresh key and compression with context takeover depends on the
+// previous messages.
+func (pm *PreparedMessage) frame(c *Connection) (frame []byte, ok bool, err error) {
+	if c.isClient {
+		return nil, false, nil
+	}
+	messageType, payload, err := pm.payload(c)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := preparedKey{subprotocol: c.subprotocol, fragmentSize: c.fragmentSize}
+	if c.deflate.shouldCompress(len(payload)) {
+		if c.deflate.writeTakeover {
+			return nil, false, nil
+		}
+		key.compressed = true
+		key.level = c.deflate.level
+	}
+	if pm.msg == nil && !pm.file {
+		// Raw payloads are identical for every subprotocol
+		key.subprotocol = ""
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if frame, ok := pm.frames[key]; ok {
+		return frame, true, nil
+	}
+	frame, err = buildFrames(byte(messageType), payload, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if pm.frames == nil {
+		pm.frames = make(map[preparedKey][]byte, 1)
+	}
+	pm.frames[key] = frame
+	return frame, true, nil
+}
+
+// buildFrames compresses and fragments payload into unmasked frames as
+// writeMessage would
+func buildFrames(opcode byte, payload []byte, key preparedKey) ([]byte, error) {
+	compressed := key.compressed
+	if compressed {
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, key.level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := fw.Flush(); err != nil {
+			return nil, err
+		}
+		deflated := buf.Bytes()
+		if !bytes.HasSuffix(deflated, deflateTail[:4]) {
+			return nil, errDeflateTrailer
+		}
+		payload = deflated[:len(deflated)-4]
+	}
+
+	frame := make([]byte, 0, len(payload)+14)
+	var header [10]byte
+	for {
+		chunk := payload
+		fin := true
+		if key.fragmentSize > 0 && len(payload) > key.fragmentSize {
+			chunk = payload[:key.fragmentSize]
+			fin = false
+		}
+		n := putFrameHeader(header[:], fin, compressed, opcode, len(chunk))
+		frame = append(frame, header[:n]...)
+		frame = append(frame, chunk...)
+		if fin {
+			return frame, nil
+		}
+		opcode = ContinuationFrame
+		compressed = false
+		payload = payload[len(chunk):]
+	}
+}
+
+// writePrepared writes a prepared message, reusing its cached frames when the
+// connection allows it
+func (c *Connection) writePrepared(pm *PreparedMessage) error {
+	frame, ok, err := pm.frame(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		messageType, payload, err := pm.payload(c)
+		if err != nil {
+			return err
+		}
+		return c.writeMessage(byte(messageType), payload)
+	}
+
+	c.lockWrite()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+	c.setWriteDeadline()
+	if _, err := c.writer.Write(frame); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// SendPrepared queues a prepared message on the socket
+func (s *Socket) SendPrepared(pm *PreparedMessage) {
+	if s.IsBanned() {
+		return
+	}
+	if pm.msg == nil || !s.hub.hasOutbound() {
+		s.conn.writePreparedAsync(pm)
+		return
+	}
+	// The shared encoding is only used if middleware left the message as is
+	s.hub.sendOutbound(s, *pm.msg, func(msg Message) error {
+		if sameMessage(msg, *pm.msg) {
+			s.conn.writePreparedAsync(pm)
+			return nil
+		}
+		return s.writeMessage(msg)
+	})
+}
@@ -0,0 +1,266 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ErrMessageTypeConflict is returned when a message type's code or name is
+// already registered
+var ErrMessageTypeConflict = errors.New("websocket: message type already registered")
+
+// MessageType describes a message type of the protocol. Applications
+// register their own types, e.g. domain events, with Hub.RegisterMessageType.
+type MessageType struct {
+	// Code is the numeric type carried in Message.T
+	Code int
+	// Name is the event name, as passed to Emit and OnEvent
+	Name string
+	// Payload is a value of the type carried in Message.Data, e.g.
+	// OrderPayload{} or &OrderPayload{}. Data of inbound messages is
+	// decoded into a new value of that type before handlers run. Nil
+	// leaves Data as decoded by the codec.
+	Payload interface{}
+	// Handler handles inbound messages of the type after the handlers
+	// registered with OnEvent
+	Handler MessageHandler
+
+	// builtin types are routed by the server
+	builtin bool
+}
+
+// builtinMessageTypes are the types handled by the server and the call
+// package
+var builtinMessageTypes = []MessageType{
+	{Code: MsgBroadcast, Name: "broadcast"},
+	{Code: MsgPrivate, Name: "private"},
+	{Code: MsgSystem, Name: "system"},
+	{Code: MsgSubscribe, Name: "subscribe"},
+	{Code: MsgUnsubscribe, Name: "unsubscribe"},
+	{Code: MsgPing, Name: "ping"},
+	{Code: MsgPong, Name: "pong"},
+	{Code: MsgError, Name: "error"},
+	{Code: MsgAck, Name: "ack"},
+	{Code: MsgFile, Name: "file"},
+	{Code: MsgTyping, Name: "typing"},
+	{Code: MsgDirect, Name: "direct"},
+	{Code: MsgThread, Name: "thread"},
+	{Code: MsgUserList, Name: "user_list"},
+	{Code: MsgSetAlias, Name: "set_alias"},
+	{Code: MsgAuth, Name: "auth"},
+	{Code: MsgJoin, Name: "join"},
+	{Code: MsgOffer, Name: "offer"},
+	{Code: MsgAnswer, Name: "answer"},
+	{Code: MsgIceCandidate, Name: "ice-candidate"},
+	{Code: MsgMute, Name: "mute"},
+	{Code: MsgUnmute, Name: "unmute"},
+	{Code: MsgHold, Name: "hold"},
+	{Code: MsgDTMF, Name: "dtmf"},
+	{Code: MsgJoined, Name: "joined"},
+	{Code: MsgPeerJoined, Name: "peer-joined"},
+	{Code: MsgPeerLeft, Name: "peer-left"},
+	{Code: MsgCallStateChanged, Name: "call-state-changed"},
+	{Code: MsgRecordingStarted, Name: "recording-started"},
+	{Code: MsgRecordingFinished, Name: "recording-finished"},
+	{Code: MsgDirectCallInvite, Name: "direct-call-invite"},
+	{Code: MsgDirectCallAccept, Name: "direct-call-accept"},
+	{Code: MsgDirectCallReject, Name: "direct-call-reject"},
+	{Code: MsgDirectCallEnd, Name: "direct-call-end"},
+	{Code: MsgDirectCallRinging, Name: "direct-call-ringing"},
+}
+
+// messageTypeAliases are extra event names of built-in types
+var messageTypeAliases = map[string]int{
+	"subscribed":   MsgAck,
+	"unsubscribed": MsgAck,
+}
+
+// builtinTypes holds only the built-in types and is never modified, so
+// codecs and clients without a hub can name them
+var builtinTypes = newTypeRegistry()
+
+// typeRegistry holds the message types of a hub
+type typeRegistry struct {
+	mu     sync.RWMutex
+	byCode map[int]MessageType
+	byName map[string]int
+}
+
+func newTypeRegistry() *typeRegistry {
+	r := &typeRegistry{
+		byCode: make(map[int]MessageType),
+		byName: make(map[string]int),
+	}
+	for _, mt := range builtinMessageTypes {
+		mt.builtin = true
+		r.byCode[mt.Code] = mt
+		r.byName[mt.Name] = mt.Code
+	}
+	for name, code := range messageTypeAliases {
+		r.byName[name] = code
+	}
+	return r
+}
+
+func (r *typeRegistry) register(mt MessageType) error {
+	if mt.Code <= 0 || mt.Name == "" {
+		return fmt.Errorf("websocket: message type needs a positive code and a name, got %d %q", mt.Code, mt.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, exists := r.byCode[mt.Code]; exists {
+		return fmt.Errorf("%w: code %d is %q", ErrMessageTypeConflict, mt.Code, existing.Name)
+	}
+	if code, exists := r.byName[mt.Name]; exists {
+		return fmt.Errorf("%w: name %q has code %d", ErrMessageTypeConflict, mt.Name, code)
+	}
+	mt.builtin = false
+	r.byCode[mt.Code] = mt
+	r.byName[mt.Name] = mt.Code
+	return nil
+}
+
+func (r *typeRegistry) setHandler(code int, payload interface{}, handler MessageHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt, exists := r.byCode[code]
+	if !exists {
+		return fmt.Errorf("websocket: message type %d is not registered", code)
+	}
+	if mt.Handler != nil {
+		return fmt.Errorf("%w: %q already has a handler", ErrMessageTypeConflict, mt.Name)
+	}
+	mt.Payload = payload
+	mt.Handler = handler
+	r.byCode[code] = mt
+	return nil
+}
+
+func (r *typeRegistry) lookup(code int) (MessageType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mt, exists := r.byCode[code]
+	return mt, exists
+}
+
+func (r *typeRegistry) all() []MessageType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]MessageType, 0, len(r.byCode))
+	for _, mt := range r.byCode {
+		types = append(types, mt)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Code < types[j].Code })
+	return types
+}
+
+func (r *typeRegistry) name(code int) string {
+	if mt, exists := r.lookup(code); exists {
+		return mt.Name
+	}
+	return "unknown"
+}
+
+func (r *typeRegistry) code(name string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if code, exists := r.byName[name]; exists {
+		return code
+	}
+	return MsgSystem
+}
+
+// RegisterMessageType adds a message type to the hub. Its code and name must
+// not be used by a built-in or previously registered type.
+func (h *Hub) RegisterMessageType(mt MessageType) error {
+	return h.types.register(mt)
+}
+
+// MustRegisterMessageType is like RegisterMessageType but panics on conflict
+func (h *Hub) MustRegisterMessageType(mt MessageType) {
+	if err := h.RegisterMessageType(mt); err != nil {
+		panic(err)
+	}
+}
+
+// SetMessageTypeHandler attaches a payload type and a handler to a
+// registered type, typically a built-in one such as MsgOffer, replacing its
+// built-in routing. It fails if the type already has a handler.
+func (h *Hub) SetMessageTypeHandler(code int, payload interface{}, handler MessageHandler) error {
+	return h.types.setHandler(code, payload, handler)
+}
+
+// LookupMessageType returns the type registered with the hub under a code
+func (h *Hub) LookupMessageType(code int) (MessageType, bool) {
+	return h.types.lookup(code)
+}
+
+// MessageTypes returns all types registered with the hub ordered by code
+func (h *Hub) MessageTypes() []MessageType {
+	return h.types.all()
+}
+
+// MessageTypeName returns the event name of a type registered with the hub,
+// or "unknown"
+func (h *Hub) MessageTypeName(code int) string {
+	return h.types.name(code)
+}
+
+// MessageTypeCode returns the code of an event name registered with the hub.
+// Unregistered names are sent as MsgSystem.
+func (h *Hub) MessageTypeCode(name string) int {
+	return h.types.code(name)
+}
+
+// MessageTypeName returns the event name of a built-in message type, or
+// "unknown". Use Hub.MessageTypeName for application types.
+func MessageTypeName(code int) string {
+	return builtinTypes.name(code)
+}
+
+// MessageTypeCode returns the code of a built-in event name. Other names are
+// sent as MsgSystem; use Hub.MessageTypeCode for application types.
+func MessageTypeCode(name string) int {
+	return builtinTypes.code(name)
+}
+
+// decodePayload converts the Data of an inbound message to the type's
+// Payload and validates it like DecodePayload. Missing Data decodes to the
+// zero value.
+func (mt MessageType) decodePayload(data interface{}) (interface{}, error) {
+	if mt.Payload == nil {
+		return data, nil
+	}
+	typ := reflect.TypeOf(mt.Payload)
+	if reflect.TypeOf(data) == typ {
+		return data, validatePayload(data)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	ptr := typ.Kind() == reflect.Pointer
+	if ptr {
+		typ = typ.Elem()
+	}
+	value := reflect.New(typ)
+	if err := json.Unmarshal(raw, value.Interface()); err != nil {
+		return nil, &Error{Code: ErrorCodeInvalidPayload, Message: "invalid " + mt.Name + " payload"}
+	}
+	if err := validatePayload(value.Interface()); err != nil {
+		return nil, err
+	}
+	if ptr {
+		return value.Interface(), nil
+	}
+	return value.Elem().Interface(), nil
+}
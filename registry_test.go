@@ -0,0 +1,158 @@
+package ws
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+type orderPayload struct {
+	OrderID string `json:"order_id" validate:"required"`
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	tests := []struct {
+		name    string
+		mt      MessageType
+		wantErr error
+	}{
+		{"new type", MessageType{Code: 100, Name: "order-updated"}, nil},
+		{"built-in code", MessageType{Code: MsgJoin, Name: "x"}, ErrMessageTypeConflict},
+		{"built-in name", MessageType{Code: 101, Name: "join"}, ErrMessageTypeConflict},
+		{"alias name", MessageType{Code: 102, Name: "subscribed"}, ErrMessageTypeConflict},
+		{"registered code", MessageType{Code: 100, Name: "other"}, ErrMessageTypeConflict},
+		{"direct call code", MessageType{Code: MsgDirectCallInvite, Name: "y"}, ErrMessageTypeConflict},
+	}
+	h := NewHub(nil)
+	for _, tt := range tests {
+		if err := h.RegisterMessageType(tt.mt); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for _, mt := range []MessageType{{Code: 0, Name: "zero"}, {Code: 103}} {
+		if err := h.RegisterMessageType(mt); err == nil {
+			t.Errorf("RegisterMessageType(%+v) succeeded", mt)
+		}
+	}
+}
+
+func TestMessageTypesPerHub(t *testing.T) {
+	a, b := NewHub(nil), NewHub(nil)
+	a.MustRegisterMessageType(MessageType{Code: 100, Name: "order-updated"})
+
+	if got := a.MessageTypeCode("order-updated"); got != 100 {
+		t.Errorf("registering hub: code = %d, want 100", got)
+	}
+	if got := b.MessageTypeCode("order-updated"); got != MsgSystem {
+		t.Errorf("other hub: code = %d, want MsgSystem", got)
+	}
+	if got := MessageTypeCode("order-updated"); got != MsgSystem {
+		t.Errorf("built-in lookup: code = %d, want MsgSystem", got)
+	}
+	if _, ok := b.LookupMessageType(100); ok {
+		t.Error("type registered on one hub is visible on another")
+	}
+	if err := b.RegisterMessageType(MessageType{Code: 100, Name: "invoice-paid"}); err != nil {
+		t.Errorf("same code on another hub: %v", err)
+	}
+}
+
+func TestLegacyEventNames(t *testing.T) {
+	a, b := NewServer(), NewServer()
+	a.hub.MustRegisterMessageType(MessageType{Code: 100, Name: "order-updated"})
+
+	tests := []struct {
+		name    string
+		server  *Server
+		payload string
+		want    int
+	}{
+		{"built-in", a, `{"event": "broadcast"}`, MsgBroadcast},
+		{"registered on the hub", a, `{"event": "order-updated"}`, 100},
+		{"registered on another hub", b, `{"event": "order-updated"}`, MsgSystem},
+		{"unknown", a, `{"event": "nope"}`, MsgSystem},
+	}
+	for _, tt := range tests {
+		_, codec, ok := tt.server.negotiateSubprotocol(httptest.NewRequest("GET", "/ws", nil))
+		if !ok {
+			t.Fatalf("%s: no codec without a subprotocol", tt.name)
+		}
+		msg, err := codec.Decode([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if msg.T != tt.want {
+			t.Errorf("%s: type = %d, want %d", tt.name, msg.T, tt.want)
+		}
+	}
+}
+
+func TestSetMessageTypeHandler(t *testing.T) {
+	h := NewHub(nil)
+	handler := func(ctx *Context) error { return nil }
+
+	tests := []struct {
+		name    string
+		code    int
+		wantErr bool
+	}{
+		{"built-in type", MsgOffer, false},
+		{"handler already set", MsgOffer, true},
+		{"unregistered type", 555, true},
+	}
+	for _, tt := range tests {
+		if err := h.SetMessageTypeHandler(tt.code, JoinPayload{}, handler); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if mt, _ := h.LookupMessageType(MsgOffer); mt.Handler == nil || !mt.builtin {
+		t.Errorf("offer type = %+v, want a built-in type with a handler", mt)
+	}
+}
+
+func TestHandleEventByType(t *testing.T) {
+	s := NewServer()
+	var handled []orderPayload
+	s.hub.MustRegisterMessageType(MessageType{
+		Code:    100,
+		Name:    "order-updated",
+		Payload: orderPayload{},
+		Handler: func(ctx *Context) error {
+			handled = append(handled, ctx.Message.Data.(orderPayload))
+			return nil
+		},
+	})
+
+	tests := []struct {
+		name     string
+		msg      Message
+		wantType int
+		wantCode int
+	}{
+		{"direct call invite", Message{T: MsgDirectCallInvite, ID: "1", Ack: true, Data: map[string]interface{}{"call_id": "c"}}, MsgAck, 0},
+		{"direct call accept", Message{T: MsgDirectCallAccept, ID: "2", Ack: true}, MsgAck, 0},
+		{"direct call reject", Message{T: MsgDirectCallReject, ID: "3", Ack: true}, MsgAck, 0},
+		{"direct call end", Message{T: MsgDirectCallEnd, ID: "4", Ack: true}, MsgAck, 0},
+		{"direct call ringing", Message{T: MsgDirectCallRinging, ID: "5", Ack: true}, MsgAck, 0},
+		{"registered type", Message{T: 100, ID: "6", Ack: true, Data: map[string]interface{}{"order_id": "42"}}, MsgAck, 0},
+		{"invalid payload", Message{T: 100, ID: "7", Data: map[string]interface{}{}}, MsgError, ErrorCodeInvalidPayload},
+		{"unregistered type", Message{T: 555, ID: "8"}, MsgError, ErrorCodeUnknownType},
+	}
+	for _, tt := range tests {
+		socket := testSocket(s.hub)
+		s.handleUnifiedMessage(socket, tt.msg, nil)
+		msgs := sentMessages(t, socket)
+		if len(msgs) != 1 {
+			t.Errorf("%s: got %d replies, want 1: %+v", tt.name, len(msgs), msgs)
+			continue
+		}
+		reply := msgs[0]
+		if reply.T != tt.wantType || reply.Code != tt.wantCode || reply.ReplyTo != tt.msg.ID {
+			t.Errorf("%s: reply = %+v, want type %d code %d", tt.name, reply, tt.wantType, tt.wantCode)
+		}
+	}
+	if len(handled) != 1 || handled[0].OrderID != "42" {
+		t.Errorf("handler got %+v", handled)
+	}
+}
@@ -0,0 +1,375 @@
+package ws
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultNamespace is the namespace of Hub.Join and Socket.Join
+const DefaultNamespace = "/"
+
+// RoomHandler is called when a socket joins or leaves a room
+type RoomHandler func(room *Room, socket *Socket)
+
+// Namespace isolates a set of rooms, e.g. "/chat" and "/calls" may both
+// have a room named "lobby" without sharing members
+type Namespace struct {
+	name string
+	hub  *Hub
+
+	mu      sync.RWMutex
+	rooms   map[string]*Room
+	onJoin  []RoomHandler
+	onLeave []RoomHandler
+}
+
+// Room is a named group of sockets within a namespace. Sending to a room
+// costs O(members), independent of the number of connected sockets.
+type Room struct {
+	name      string
+	namespace *Namespace
+	// persistent rooms were created explicitly and outlive their members
+	persistent bool
+
+	mu       sync.RWMutex
+	members  map[string]*Socket
+	metadata map[string]interface{}
+}
+
+// roomKey identifies a room a socket is a member of
+type roomKey struct {
+	namespace string
+	room      string
+}
+
+// Namespace returns the namespace with the given name, creating it on first
+// use
+func (h *Hub) Namespace(name string) *Namespace {
+	h.nsMu.Lock()
+	defer h.nsMu.Unlock()
+
+	ns, exists := h.namespaces[name]
+	if !exists {
+		ns = &Namespace{name: name, hub: h, rooms: make(map[string]*Room)}
+		h.namespaces[name] = ns
+	}
+	return ns
+}
+
+// Namespaces returns the names of all namespaces
+func (h *Hub) Namespaces() []string {
+	h.nsMu.RLock()
+	defer h.nsMu.RUnlock()
+
+	names := make([]string, 0, len(h.namespaces))
+	for name := range h.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Room returns a room of the default namespace, creating it if needed
+func (h *Hub) Room(name string) *Room {
+	return h.Namespace(DefaultNamespace).Room(name)
+}
+
+// Join adds a socket to a room of the default namespace
+func (h *Hub) Join(socket *Socket, room string) *Room {
+	return h.Namespace(DefaultNamespace).Join(socket, room)
+}
+
+// Leave removes a socket from a room of the default namespace
+func (h *Hub) Leave(socket *Socket, room string) {
+	h.Namespace(DefaultNamespace).Leave(socket, room)
+}
+
+// leaveAllRooms removes a disconnected socket from every room it joined
+func (h *Hub) leaveAllRooms(socket *Socket) {
+	socket.mu.RLock()
+	keys := make([]roomKey, 0, len(socket.rooms))
+	for key := range socket.rooms {
+		keys = append(keys, key)
+	}
+	socket.mu.RUnlock()
+
+	for _, key := range keys {
+		h.Namespace(key.namespace).Leave(socket, key.room)
+	}
+}
+
+// Name returns the namespace name
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// OnJoin registers a handler called after a socket joined a room of the
+// namespace
+func (ns *Namespace) OnJoin(handler RoomHandler) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.onJoin = append(ns.onJoin, handler)
+}
+
+// OnLeave registers a handler called after a socket left a room of the
+// namespace, also when it disconnected
+func (ns *Namespace) OnLeave(handler RoomHandler) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.onLeave = append(ns.onLeave, handler)
+}
+
+// Room returns the room with the given name, creating it if needed. Rooms
+// created this way are kept when their last member leaves, together with
+// their metadata, until DeleteRoom is called.
+func (ns *Namespace) Room(name string) *Room {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	room := ns.room(name)
+	room.persistent = true
+	return room
+}
+
+// room returns a room, creating a transient one if needed. ns.mu must be
+// held for writing.
+func (ns *Namespace) room(name string) *Room {
+	room, exists := ns.rooms[name]
+	if !exists {
+		room = &Room{
+			name:      name,
+			namespace: ns,
+			members:   make(map[string]*Socket),
+			metadata:  make(map[string]interface{}),
+		}
+		ns.rooms[name] = room
+	}
+	return room
+}
+
+// GetRoom returns the room with the given name, or nil if it does not exist
+func (ns *Namespace) GetRoom(name string) *Room {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.rooms[name]
+}
+
+// Rooms returns the names of all rooms in the namespace
+func (ns *Namespace) Rooms() []string {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	names := make([]string, 0, len(ns.rooms))
+	for name := range ns.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeleteRoom removes a room after all of its members have left it
+func (ns *Namespace) DeleteRoom(name string) {
+	room := ns.GetRoom(name)
+	if room == nil {
+		return
+	}
+	for _, socket := range room.Members() {
+		ns.Leave(socket, name)
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.rooms[name] == room {
+		delete(ns.rooms, name)
+	}
+}
+
+// Join adds a socket to a room, creating the room if needed. Rooms created
+// by a join are removed once their last member leaves.
+func (ns *Namespace) Join(socket *Socket, name string) *Room {
+	ns.mu.Lock()
+	room := ns.room(name)
+	room.mu.Lock()
+	_, already := room.members[socket.ID]
+	room.members[socket.ID] = socket
+	room.mu.Unlock()
+	handlers := ns.onJoin
+	ns.mu.Unlock()
+
+	if already {
+		return room
+	}
+
+	socket.mu.Lock()
+	socket.rooms[roomKey{ns.name, name}] = struct{}{}
+	socket.mu.Unlock()
+
+	// A socket that disconnected meanwhile has already left its rooms
+	select {
+	case <-socket.conn.closeChan:
+		ns.Leave(socket, name)
+		return room
+	default:
+	}
+
+	for _, handler := range handlers {
+		handler(room, socket)
+	}
+	return room
+}
+
+// Leave removes a socket from a room
+func (ns *Namespace) Leave(socket *Socket, name string) {
+	ns.mu.Lock()
+	room, exists := ns.rooms[name]
+	if !exists {
+		ns.mu.Unlock()
+		return
+	}
+	room.mu.Lock()
+	_, member := room.members[socket.ID]
+	delete(room.members, socket.ID)
+	empty := len(room.members) == 0
+	room.mu.Unlock()
+	if empty && !room.persistent {
+		delete(ns.rooms, name)
+	}
+	handlers := ns.onLeave
+	ns.mu.Unlock()
+
+	if !member {
+		return
+	}
+
+	socket.mu.Lock()
+	delete(socket.rooms, roomKey{ns.name, name})
+	socket.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(room, socket)
+	}
+}
+
+// Emit sends an event to every member of a room
+func (ns *Namespace) Emit(room string, event string, data interface{}) {
+	if r := ns.GetRoom(room); r != nil {
+		r.Emit(event, data)
+	}
+}
+
+// Name returns the room name
+func (r *Room) Name() string {
+	return r.name
+}
+
+// Namespace returns the namespace the room belongs to
+func (r *Room) Namespace() *Namespace {
+	return r.namespace
+}
+
+// Members returns the sockets in the room
+func (r *Room) Members() []*Socket {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]*Socket, 0, len(r.members))
+	for _, socket := range r.members {
+		members = append(members, socket)
+	}
+	return members
+}
+
+// Size returns the number of sockets in the room
+func (r *Room) Size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// Has reports whether a socket is in the room
+func (r *Room) Has(socket *Socket) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, exists := r.members[socket.ID]
+	return exists
+}
+
+// SetMeta sets a metadata value on the room
+func (r *Room) SetMeta(key string, value interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metadata[key] = value
+}
+
+// GetMeta gets a metadata value of the room
+func (r *Room) GetMeta(key string) interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metadata[key]
+}
+
+// Emit sends an event to every member of the room
+func (r *Room) Emit(event string, data interface{}) {
+	r.EmitMessageExcept(Message{T: r.namespace.hub.MessageTypeCode(event), Data: data}, nil)
+}
+
+// EmitExcept sends an event to every member of the room except one
+func (r *Room) EmitExcept(event string, data interface{}, excludeSocket *Socket) {
+	r.EmitMessageExcept(Message{T: r.namespace.hub.MessageTypeCode(event), Data: data}, excludeSocket)
+}
+
+// EmitMessage sends a unified Message to every member of the room
+func (r *Room) EmitMessage(msg Message) {
+	r.EmitMessageExcept(msg, nil)
+}
+
+// EmitMessageExcept sends a unified Message to every member of the room
+// except one. The message is encoded once for all members.
+func (r *Room) EmitMessageExcept(msg Message, excludeSocket *Socket) {
+	r.send(PrepareMessage(msg), excludeSocket)
+}
+
+// EmitBinary sends binary data to every member of the room except one
+func (r *Room) EmitBinary(data []byte, excludeSocket *Socket) {
+	r.send(prepareFileData(data), excludeSocket)
+}
+
+// send fans a prepared message out to the members
+func (r *Room) send(prepared *PreparedMessage, excludeSocket *Socket) {
+	// Members are copied so a slow socket does not hold the room lock
+	r.mu.RLock()
+	sockets := make([]*Socket, 0, len(r.members))
+	for _, socket := range r.members {
+		if socket != excludeSocket && !socket.IsBanned() {
+			sockets = append(sockets, socket)
+		}
+	}
+	r.mu.RUnlock()
+
+	sendAll(sockets, prepared)
+}
+
+// Join adds the socket to a room of the default namespace
+func (s *Socket) Join(room string) *Room {
+	return s.hub.Join(s, room)
+}
+
+// Leave removes the socket from a room of the default namespace
+func (s *Socket) Leave(room string) {
+	s.hub.Leave(s, room)
+}
+
+// Rooms returns the rooms of a namespace the socket is in
+func (s *Socket) Rooms(namespace string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rooms []string
+	for key := range s.rooms {
+		if key.namespace == namespace {
+			rooms = append(rooms, key.room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
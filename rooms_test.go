@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomMembership(t *testing.T) {
+	h := NewHub(nil)
+	a, b := testSocket(h), testSocket(h)
+
+	tests := []struct {
+		name      string
+		apply     func()
+		room      string
+		wantSize  int
+		wantRooms []string
+	}{
+		{"join", func() { a.Join("lobby") }, "lobby", 1, []string{"lobby"}},
+		{"second member", func() { b.Join("lobby") }, "lobby", 2, []string{"lobby"}},
+		{"join twice", func() { a.Join("lobby") }, "lobby", 2, []string{"lobby"}},
+		{"another room", func() { a.Join("game") }, "game", 1, []string{"game", "lobby"}},
+		{"leave", func() { a.Leave("lobby") }, "lobby", 1, []string{"game"}},
+		{"leave unknown room", func() { a.Leave("nowhere") }, "lobby", 1, []string{"game"}},
+	}
+	for _, tt := range tests {
+		tt.apply()
+		if got := h.Room(tt.room).Size(); got != tt.wantSize {
+			t.Errorf("%s: room %q size = %d, want %d", tt.name, tt.room, got, tt.wantSize)
+		}
+		if got := a.Rooms(DefaultNamespace); !reflect.DeepEqual(got, tt.wantRooms) {
+			t.Errorf("%s: rooms = %v, want %v", tt.name, got, tt.wantRooms)
+		}
+	}
+}
+
+func TestRoomsAndTopicsAreSeparate(t *testing.T) {
+	h := NewHub(nil)
+	member, subscriber := testSocket(h), testSocket(h)
+	member.Join("x")
+	if err := subscriber.Subscribe("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Room("x").Has(subscriber) {
+		t.Error("topic subscriber is a member of the room of the same name")
+	}
+	if subs := h.Subscribers("x"); len(subs) != 1 || subs[0] != subscriber {
+		t.Errorf("subscribers of topic x = %v, want only the subscriber", subs)
+	}
+	if len(member.Subscriptions()) != 0 {
+		t.Errorf("room member has subscriptions %v", member.Subscriptions())
+	}
+}
+
+func TestDeprecatedConnectionSubscriptions(t *testing.T) {
+	h := NewHub(nil)
+	socket := testSocket(h)
+	c := socket.conn
+
+	tests := []struct {
+		name  string
+		apply func()
+		want  map[string]bool
+	}{
+		{"subscribe", func() { c.Subscribe("news") }, map[string]bool{"news": true}},
+		{"wildcard", func() { c.Subscribe("alerts/#") }, map[string]bool{"news": true, "alerts/#": true}},
+		{"invalid filter ignored", func() { c.Subscribe("a/#/b") }, map[string]bool{"news": true, "alerts/#": true}},
+		{"unsubscribe", func() { c.Unsubscribe("news") }, map[string]bool{"alerts/#": true}},
+		{"via socket", func() { socket.Subscribe("chat") }, map[string]bool{"alerts/#": true, "chat": true}},
+	}
+	for _, tt := range tests {
+		tt.apply()
+		if got := c.GetSubscriptions(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: subscriptions = %v, want %v", tt.name, got, tt.want)
+		}
+		for filter := range tt.want {
+			if !c.IsSubscribed(filter) {
+				t.Errorf("%s: IsSubscribed(%q) = false", tt.name, filter)
+			}
+		}
+	}
+	if subs := h.Subscribers("alerts/fire"); len(subs) != 1 {
+		t.Errorf("wrapper subscription not matched by the hub: %v", subs)
+	}
+
+	client := &Connection{isClient: true}
+	client.Subscribe("news")
+	if client.IsSubscribed("news") || len(client.GetSubscriptions()) != 0 {
+		t.Error("client connection has subscriptions")
+	}
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultRequestTimeout bounds Socket.Request when its context has no
+// deadline
+const DefaultRequestTimeout = 10 * time.Second
+
+// ErrSocketClosed is returned by Socket.Request when the socket disconnects
+// before replying
+var ErrSocketClosed = errors.New("websocket: socket closed")
+
+// Requests and replies are correlated by message ID: a reply carries the ID
+// of the message it answers in ReplyTo. An inbound message with an ID that
+// sets Ack is a request and is answered exactly once, with its reply, a
+// MsgError, or a MsgAck if handling it produced no reply. Without Ack only
+// replies and errors are sent.
+
+// Reply sends reply to the socket as the answer to request, which it
+// references in ReplyTo
+func (s *Socket) Reply(request Message, reply Message) {
+	if request.ID != "" {
+		reply.ReplyTo = request.ID
+	}
+	s.SendMessage(reply)
+}
+
+// ReplyError answers request with a MsgError for err
+func (s *Socket) ReplyError(request Message, err error) {
+	s.Reply(request, errorMessage(err, s.hub.MessageTypeName(request.T)))
+}
+
+// Request sends msg to the socket and waits for the client's reply, the
+// first message whose ReplyTo is msg's ID. msg is given an ID if it has
+// none. A MsgError reply is returned along with its Err. Without a deadline
+// on ctx the wait is bounded by DefaultRequestTimeout.
+func (s *Socket) Request(ctx context.Context, msg Message) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+	if msg.ID == "" {
+		msg.ID = s.hub.NewID()
+	}
+
+	reply := make(chan Message, 1)
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]chan Message)
+	}
+	s.pending[msg.ID] = reply
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, msg.ID)
+		s.mu.Unlock()
+	}()
+
+	s.SendMessage(msg)
+
+	select {
+	case resp := <-reply:
+		return resp, resp.Err()
+	case <-s.ctx.Done():
+		return Message{}, ErrSocketClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// resolveReply hands a reply to the Request awaiting it, reporting whether
+// one was
+func (s *Socket) resolveReply(msg Message) bool {
+	if msg.ReplyTo == "" {
+		return false
+	}
+	s.mu.Lock()
+	reply, waiting := s.pending[msg.ReplyTo]
+	delete(s.pending, msg.ReplyTo)
+	s.mu.Unlock()
+
+	if waiting {
+		reply <- msg
+	}
+	return waiting
+}
@@ -0,0 +1,209 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestAcks(t *testing.T) {
+	s := NewServer()
+	s.OnEvent("typing", func(ctx *Context) error {
+		if ctx.Message.Data == "fail" {
+			return &Error{Code: 418, Message: "teapot"}
+		}
+		return nil
+	})
+	s.OnEvent("thread", func(ctx *Context) error {
+		ctx.Reply(Message{T: MsgSystem, Data: "answer"})
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		msg       Message
+		others    int
+		wantTypes []int
+		wantData  map[string]interface{}
+	}{
+		{"handled without ack", Message{T: MsgTyping, ID: "1"}, 0, nil, nil},
+		{"handled with ack", Message{T: MsgTyping, ID: "2", Ack: true}, 0, []int{MsgAck}, map[string]interface{}{"status": "received"}},
+		{"error without ack", Message{T: MsgTyping, ID: "3", Data: "fail"}, 0, []int{MsgError}, nil},
+		{"error with ack", Message{T: MsgTyping, ID: "4", Ack: true, Data: "fail"}, 0, []int{MsgError}, nil},
+		{"reply with ack", Message{T: MsgThread, ID: "5", Ack: true}, 0, []int{MsgSystem}, nil},
+		{"ping", Message{T: MsgPing, ID: "6"}, 0, []int{MsgPong}, nil},
+		{"broadcast without ack", Message{T: MsgBroadcast, ID: "7", Data: "x"}, 2, nil, nil},
+		{"broadcast with ack", Message{T: MsgBroadcast, ID: "8", Ack: true, Data: "x"}, 2, []int{MsgAck}, map[string]interface{}{"status": "queued", "recipients": float64(2)}},
+		{"subscribe without ack", Message{T: MsgSubscribe, ID: "9", Topic: "news"}, 0, nil, nil},
+		{"subscribe with ack", Message{T: MsgSubscribe, ID: "10", Ack: true, Topic: "news"}, 0, []int{MsgAck}, map[string]interface{}{"action": "subscribed"}},
+		{"unsubscribe without ack", Message{T: MsgUnsubscribe, ID: "11", Topic: "news"}, 0, nil, nil},
+		{"registered type without handler", Message{T: MsgPeerLeft, ID: "12"}, 0, nil, nil},
+		{"registered type without handler with ack", Message{T: MsgPeerLeft, ID: "13", Ack: true}, 0, []int{MsgAck}, map[string]interface{}{"status": "received"}},
+	}
+	for _, tt := range tests {
+		sender := testSocket(s.hub)
+		others := make([]*Socket, tt.others)
+		for i := range others {
+			others[i] = testSocket(s.hub)
+		}
+
+		s.handleUnifiedMessage(sender, tt.msg, nil)
+		// Messages that are not replies, such as the topic list broadcast
+		// after a subscribe, are ignored
+		var replies []Message
+		for _, sent := range sentMessages(t, sender) {
+			if sent.ReplyTo != "" {
+				replies = append(replies, sent)
+			}
+		}
+		if len(replies) != len(tt.wantTypes) {
+			t.Errorf("%s: got %d replies %+v, want %d", tt.name, len(replies), replies, len(tt.wantTypes))
+		} else {
+			for i, reply := range replies {
+				if reply.T != tt.wantTypes[i] || reply.ReplyTo != tt.msg.ID {
+					t.Errorf("%s: reply %d = %+v, want type %d replying to %q", tt.name, i, reply, tt.wantTypes[i], tt.msg.ID)
+				}
+			}
+			if tt.wantData != nil {
+				data, _ := replies[0].Data.(map[string]interface{})
+				for key, want := range tt.wantData {
+					if data[key] != want {
+						t.Errorf("%s: ack %s = %v, want %v", tt.name, key, data[key], want)
+					}
+				}
+			}
+		}
+		for _, other := range others {
+			sentMessages(t, other)
+			s.hub.RemoveSocket(other.ID)
+		}
+		s.hub.RemoveSocket(sender.ID)
+	}
+}
+
+func TestSocketRequest(t *testing.T) {
+	h := NewHub(nil)
+
+	tests := []struct {
+		name    string
+		reply   func(socket *Socket, request Message)
+		timeout time.Duration
+		wantErr error
+		wantMsg interface{}
+	}{
+		{
+			name: "reply",
+			reply: func(socket *Socket, request Message) {
+				socket.resolveReply(Message{T: MsgAck, ReplyTo: request.ID, Data: "done"})
+			},
+			timeout: time.Second,
+			wantMsg: "done",
+		},
+		{
+			name: "reply to another request is ignored",
+			reply: func(socket *Socket, request Message) {
+				if socket.resolveReply(Message{T: MsgAck, ReplyTo: "other"}) {
+					t.Error("reply to an unknown request was resolved")
+				}
+			},
+			timeout: 20 * time.Millisecond,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:    "timeout",
+			reply:   func(*Socket, Message) {},
+			timeout: 20 * time.Millisecond,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "socket closed",
+			reply: func(socket *Socket, request Message) {
+				socket.cancel()
+			},
+			timeout: time.Second,
+			wantErr: ErrSocketClosed,
+		},
+	}
+	for _, tt := range tests {
+		socket := testSocket(h)
+		go func() {
+			// Wait for the request to be queued before answering it
+			out := <-socket.conn.writeChan
+			request, err := socket.conn.messageCodec().Decode(out.data)
+			if err != nil || request.ID == "" {
+				t.Errorf("%s: request %+v, %v", tt.name, request, err)
+			}
+			tt.reply(socket, request)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		reply, err := socket.Request(ctx, Message{T: MsgSystem, Data: "question"})
+		cancel()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantMsg != nil && reply.Data != tt.wantMsg {
+			t.Errorf("%s: reply = %+v", tt.name, reply)
+		}
+		socket.mu.RLock()
+		pending := len(socket.pending)
+		socket.mu.RUnlock()
+		if pending != 0 {
+			t.Errorf("%s: %d requests left pending", tt.name, pending)
+		}
+	}
+}
+
+func TestSocketRequestErrorReply(t *testing.T) {
+	socket := testSocket(NewHub(nil))
+	go func() {
+		out := <-socket.conn.writeChan
+		request, _ := socket.conn.messageCodec().Decode(out.data)
+		socket.resolveReply(Message{T: MsgError, Code: 409, ReplyTo: request.ID, Data: map[string]interface{}{"message": "conflict"}})
+	}()
+
+	_, err := socket.Request(context.Background(), Message{T: MsgSystem})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != 409 || e.Message != "conflict" {
+		t.Fatalf("error = %#v, want *Error 409 conflict", err)
+	}
+}
+
+func TestRequestCodecs(t *testing.T) {
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", JSONCodec{}},
+		{"compact", CompactCodec{}},
+		{"msgpack", MsgPackCodec{}},
+		{"cbor", CBORCodec{}},
+	}
+	msgs := []struct {
+		name string
+		msg  Message
+	}{
+		{"request", Message{T: MsgTyping, ID: "1"}},
+		{"request with ack", Message{T: MsgTyping, ID: "1", Ack: true}},
+		{"reply", Message{T: MsgAck, ID: "2", ReplyTo: "1"}},
+		{"error reply", Message{T: MsgError, Code: 409, ReplyTo: "1"}},
+		{"reply without id", Message{T: MsgSystem, ReplyTo: "1"}},
+	}
+	for _, c := range codecs {
+		for _, tt := range msgs {
+			data, err := c.codec.Encode(tt.msg)
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			msg, err := c.codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			if msg.T != tt.msg.T || msg.ID != tt.msg.ID || msg.Ack != tt.msg.Ack ||
+				msg.ReplyTo != tt.msg.ReplyTo || msg.Code != tt.msg.Code {
+				t.Errorf("%s %s: decoded %+v, want %+v", c.name, tt.name, msg, tt.msg)
+			}
+		}
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,15 +20,53 @@ type CallManager interface {
 
 // Server wraps the Hub for backward compatibility
 type Server struct {
-	hub         *Hub
-	callManager CallManager
+	hub            *Hub
+	callManager    CallManager
+	fragmentSize   int
+	compression    *CompressionOptions
+	closeTimeout   time.Duration
+	maxFrameSize   int64
+	maxMessageSize int64
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+	idleTimeout    time.Duration
+	writeTimeout   time.Duration
+	subprotocols   map[string]Codec
+	backpressure   BackpressurePolicy
+	blockTimeout   time.Duration
+
+	// Handshake authorization
+	allowedOrigins []string
+	originChecker  OriginChecker
+	authenticator  Authenticator
+
+	// poller parks idle connections in netpoll mode
+	poller *poller
+
+	// Shutdown state; wg tracks upgrades and connection goroutines
+	shutdownMu    sync.Mutex
+	shuttingDown  bool
+	reconnectHint string
+	wg            sync.WaitGroup
 }
 
 // NewServer creates a new WebSocket server with Hub
 func NewServer() *Server {
 	storage := NewInMemoryMessageStorage(24 * time.Hour)
 	return &Server{
-		hub: NewHub(storage),
+		hub:            NewHub(storage),
+		maxFrameSize:   DefaultMaxFrameSize,
+		maxMessageSize: DefaultMaxMessageSize,
+		pingInterval:   DefaultPingInterval,
+		pongTimeout:    DefaultPongTimeout,
+		writeTimeout:   DefaultWriteTimeout,
+		subprotocols: map[string]Codec{
+			SubprotocolJSON:    JSONCodec{},
+			SubprotocolCompact: CompactCodec{},
+			SubprotocolText:    TextCodec{},
+			SubprotocolMsgPack: MsgPackCodec{},
+			SubprotocolCBOR:    CBORCodec{},
+		},
 	}
 }
 
@@ -38,20 +76,18 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if !s.beginUpgrade() {
+		rejectShutdown(w)
+		return
+	}
+	defer s.wg.Done()
 
-	// Check authentication (header or query) - disabled for demo
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		token = r.URL.Query().Get("token")
+	// Refuse cross-site handshakes from browsers
+	if !s.checkOrigin(r) {
+		log.Printf("Handshake from %s rejected: origin %q not allowed", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", 403)
+		return
 	}
-	// For demo purposes, allow connections without authentication
-	// Comment out the authentication check
-	/*
-		if token != "mysecrettoken" && token != "Bearer mysecrettoken" {
-			http.Error(w, "Unauthorized", 401)
-			return
-		}
-	*/
 
 	// Check for WebSocket headers
 	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
@@ -66,10 +102,20 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Pick a subprotocol; clients that offer only unknown ones are rejected
+	subprotocol, codec, ok := s.negotiateSubprotocol(r)
+	if !ok {
+		http.Error(w, "Unsupported subprotocol", 400)
+		return
+	}
+
 	// Compute accept key
-	h := sha1.New()
-	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	accept := ComputeAcceptKey(key)
 
 	// Hijack the connection
 	hj, ok := w.(http.Hijacker)
@@ -84,32 +130,71 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Negotiate permessage-deflate if enabled
+	var deflate *deflateState
+	extensions := ""
+	if s.compression != nil {
+		if params, ok := negotiateDeflate(r, s.compression); ok {
+			deflate = newDeflateState(params, s.compression)
+			extensions = "Sec-WebSocket-Extensions: " + params.String() + "\r\n"
+		}
+	}
+	if subprotocol != "" {
+		extensions += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+
 	// Send upgrade response
 	response := fmt.Sprintf("HTTP/1.1 101 Switching Protocols\r\n"+
 		"Upgrade: websocket\r\n"+
 		"Connection: Upgrade\r\n"+
-		"Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+		"Sec-WebSocket-Accept: %s\r\n%s\r\n", accept, extensions)
 	conn.Write([]byte(response))
 
 	// Create connection
 	wsConn := &Connection{
-		conn:          conn,
-		reader:        bufio.NewReader(conn),
-		writer:        bufio.NewWriter(conn),
-		subscriptions: make(map[string]bool),
-		writeChan:     make(chan []byte, 256), // Buffered channel for high throughput
-		binaryChan:    make(chan []byte, 256), // Buffered channel for binary data
-		closeChan:     make(chan bool),
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+		writer:         bufio.NewWriter(conn),
+		writeChan:      make(chan outboundMessage, 256), // Buffered channel for high throughput
+		controlChan:    make(chan outboundMessage, controlQueueSize),
+		closeChan:      make(chan bool),
+		fragmentSize:   s.fragmentSize,
+		deflate:        deflate,
+		subprotocol:    subprotocol,
+		codec:          codec,
+		closeTimeout:   s.closeTimeout,
+		maxFrameSize:   s.maxFrameSize,
+		maxMessageSize: s.maxMessageSize,
+		keepalive: keepalive{
+			pingInterval: s.pingInterval,
+			pongTimeout:  s.pongTimeout,
+			idleTimeout:  s.idleTimeout,
+			writeTimeout: s.writeTimeout,
+		},
 	}
+	if s.poller != nil && s.poller.canPoll(conn) {
+		// Buffers are borrowed from pools while in use
+		wsConn.pooled = true
+		wsConn.writers = &s.wg
+		wsConn.reader = nil
+		wsConn.writer = nil
+	}
+	wsConn.backpressure.setPolicy(s.backpressure, s.blockTimeout)
+	wsConn.refreshReadDeadline()
 
 	// Create socket and add to hub
 	socket := s.hub.NewSocket(wsConn)
 	if socket == nil {
 		return // Connection limit reached
 	}
+	// Offline messages are delivered below, once the writer is running
+	socket.setIdentity(identity)
 
-	// Start writer goroutine for async writes
-	go wsConn.writerLoop()
+	// Start writer goroutine for async writes; in netpoll mode a writer
+	// is started on demand
+	if !wsConn.pooled {
+		s.goTracked(wsConn.writerLoop)
+	}
 
 	// Trigger connect event
 	s.hub.triggerHandlers("connect", socket)
@@ -120,8 +205,21 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error delivering offline messages to %s: %v", socket.ID, err)
 	}
 
-	// Handle connection in goroutine
-	go s.handleConnection(socket)
+	// Handle connection in goroutine, or park it in the poller until it
+	// becomes readable
+	if wsConn.pooled {
+		s.startNetpoll(socket)
+	} else {
+		s.goTracked(func() { s.handleConnection(socket) })
+	}
+}
+
+// ComputeAcceptKey returns the Sec-WebSocket-Accept value for a
+// Sec-WebSocket-Key (RFC 6455 section 4.2.2)
+func ComputeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
 func (s *Server) GetHub() *Hub {
@@ -133,6 +231,86 @@ func (s *Server) SetCallManager(cm CallManager) {
 	s.callManager = cm
 }
 
+// SetFragmentSize sets the maximum payload size of outbound frames. Messages
+// larger than size are sent as a sequence of continuation frames; 0 disables
+// fragmentation. Applies to connections accepted after the call.
+func (s *Server) SetFragmentSize(size int) {
+	s.fragmentSize = size
+}
+
+// EnableCompression enables permessage-deflate (RFC 7692) for clients that
+// offer it. Applies to connections accepted after the call.
+func (s *Server) EnableCompression(opts CompressionOptions) {
+	s.compression = &opts
+}
+
+// SetCloseTimeout sets how long a socket waits for the client to answer a
+// close frame before the TCP connection is forcibly closed
+func (s *Server) SetCloseTimeout(timeout time.Duration) {
+	s.closeTimeout = timeout
+}
+
+// SetMaxFrameSize sets the largest frame payload accepted from clients.
+// Larger frames close the connection with CloseMessageTooBig; 0 disables the
+// limit.
+func (s *Server) SetMaxFrameSize(size int64) {
+	s.maxFrameSize = size
+}
+
+// SetMaxMessageSize sets the largest message accepted from clients after
+// reassembly and decompression. Larger messages close the connection with
+// CloseMessageTooBig; 0 disables the limit.
+func (s *Server) SetMaxMessageSize(size int64) {
+	s.maxMessageSize = size
+}
+
+// SetKeepalive configures server pings. A ping is sent every pingInterval and
+// a socket whose pong does not arrive within pongTimeout is disconnected.
+// A zero pingInterval disables pings.
+func (s *Server) SetKeepalive(pingInterval, pongTimeout time.Duration) {
+	s.pingInterval = pingInterval
+	s.pongTimeout = pongTimeout
+}
+
+// SetIdleTimeout disconnects sockets that send nothing, not even a pong, for
+// the given duration. 0 disables the idle timeout.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetWriteTimeout bounds how long a single write to a client may block.
+// 0 disables the write timeout.
+func (s *Server) SetWriteTimeout(timeout time.Duration) {
+	s.writeTimeout = timeout
+}
+
+// RegisterSubprotocol registers a named subprotocol and the codec used to
+// encode and decode messages on connections that negotiate it. The built-in
+// JSON, compact, text, MessagePack and CBOR subprotocols are registered by
+// NewServer.
+func (s *Server) RegisterSubprotocol(name string, codec Codec) {
+	s.subprotocols[name] = codec
+}
+
+// negotiateSubprotocol selects the first subprotocol offered by the client
+// that the server supports. Clients that offer none get the format-guessing
+// legacy codec; ok is false when every offered subprotocol is unknown.
+func (s *Server) negotiateSubprotocol(r *http.Request) (name string, codec Codec, ok bool) {
+	offered := r.Header.Values("Sec-WebSocket-Protocol")
+	if len(offered) == 0 {
+		return "", legacyCodec{types: s.hub.types}, true
+	}
+	for _, header := range offered {
+		for _, name := range strings.Split(header, ",") {
+			name = strings.TrimSpace(name)
+			if codec, exists := s.subprotocols[name]; exists {
+				return name, codec, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
 // Convenience methods for easy access to Hub functionality
 
 // On registers a global event handler
@@ -145,11 +323,31 @@ func (s *Server) OnConnect(handler Handler) {
 	s.hub.OnConnect(handler)
 }
 
-// OnMessage registers a handler for messages
-func (s *Server) OnMessage(handler Handler) {
+// OnMessage registers a handler for every decoded message
+func (s *Server) OnMessage(handler MessageHandler) {
 	s.hub.OnMessage(handler)
 }
 
+// OnEvent registers a handler for messages of one type
+func (s *Server) OnEvent(event string, handler MessageHandler) {
+	s.hub.OnEvent(event, handler)
+}
+
+// RegisterMessageType adds an application message type to the server's hub
+func (s *Server) RegisterMessageType(mt MessageType) error {
+	return s.hub.RegisterMessageType(mt)
+}
+
+// Use appends middleware for inbound messages
+func (s *Server) Use(middleware ...Middleware) {
+	s.hub.Use(middleware...)
+}
+
+// UseOutbound appends middleware for outbound messages
+func (s *Server) UseOutbound(middleware ...OutboundMiddleware) {
+	s.hub.UseOutbound(middleware...)
+}
+
 // OnClose registers a handler for connection closes
 func (s *Server) OnClose(handler Handler) {
 	s.hub.OnClose(handler)
@@ -180,6 +378,23 @@ func (s *Server) Emit(socketID string, event string, data interface{}) {
 	s.hub.Emit(socketID, event, data)
 }
 
+// EmitToUser sends a message to every socket of a user, storing it while the
+// user is offline
+func (s *Server) EmitToUser(userID string, event string, data interface{}) {
+	s.hub.EmitToUser(userID, event, data)
+}
+
+// Publish sends a message to the sockets subscribed to a topic
+func (s *Server) Publish(topic string, event string, data interface{}) error {
+	return s.hub.Publish(topic, event, data)
+}
+
+// SetGlobalTopics sets the topics whose messages go to every socket,
+// "general" by default
+func (s *Server) SetGlobalTopics(topics ...string) {
+	s.hub.SetGlobalTopics(topics...)
+}
+
 // GetSocket gets a socket by ID
 func (s *Server) GetSocket(socketID string) *Socket {
 	return s.hub.GetSocket(socketID)
@@ -217,185 +432,163 @@ func (s *Server) GetConnectionCount() int64 {
 
 // handleConnection handles a WebSocket connection
 func (s *Server) handleConnection(socket *Socket) {
-	defer func() {
-		socket.conn.conn.Close()
-		// Signal writer to stop
-		close(socket.conn.closeChan)
-		// Send empty message to unblock writer
-		select {
-		case socket.conn.writeChan <- []byte{}:
-		default:
-		}
-		s.hub.RemoveSocket(socket.ID)
-		s.hub.triggerHandlers("close", socket)
-	}()
+	defer s.finishConnection(socket)
 
 	for {
-		opcode, payload, err := socket.conn.readFrame()
+		messageType, payload, err := socket.conn.ReadMessage()
 		if err != nil {
-			log.Println("Read frame error:", err)
+			s.handleReadError(socket, err)
 			return
 		}
+		s.dispatch(socket, messageType, payload)
+	}
+}
 
-		switch opcode {
-		case TextMessage:
-			// Handle custom events
-			s.handleMessage(socket, payload)
-		case BinaryMessage:
-			// Handle binary file data
-			s.handleBinaryMessage(socket, payload)
-		case CloseMessage:
-			return
-		case PingMessage:
-			socket.conn.writeMessage(PongMessage, payload)
+// dispatch routes a data message to its handler
+func (s *Server) dispatch(socket *Socket, messageType int, payload []byte) {
+	switch {
+	case messageType == socket.conn.messageCodec().MessageType():
+		// Handle custom events
+		s.handleMessage(socket, payload)
+	case messageType == BinaryMessage:
+		// Handle binary file data
+		ctx := &Context{
+			Context: socket.ctx,
+			Socket:  socket,
+			Message: Message{T: MsgFile},
+			Payload: payload,
+			Event:   s.hub.MessageTypeName(MsgFile),
+			Binary:  true,
 		}
+		s.hub.handleInbound(ctx, func(ctx *Context) error {
+			s.handleBinaryMessage(ctx.Socket, ctx.Payload)
+			return nil
+		})
+	default:
+		// Text frames carry no meaning on a binary codec connection
+		socket.SendMessage(Message{
+			T:    MsgError,
+			Data: map[string]string{"message": "text frames are not supported by subprotocol " + socket.conn.subprotocol},
+		})
 	}
 }
 
-// handleMessage handles incoming messages
-func (s *Server) handleMessage(socket *Socket, payload []byte) {
-	message := string(payload)
-
-	// Trigger message event
-	s.hub.triggerHandlers("message", socket)
-
-	// Try to parse as JSON first (this handles both arrays and objects)
-	var jsonValue interface{}
-	if err := json.Unmarshal(payload, &jsonValue); err == nil {
-		// Check if it's an array (legacy ultra-compact format)
-		if arr, ok := jsonValue.([]interface{}); ok {
-			var msg Message
-			// [type, topic?, data?, id?, to?, code?]
-			if len(arr) > 0 {
-				switch t := arr[0].(type) {
-				case float64:
-					msg.T = int(t)
-				case int:
-					msg.T = t
-				}
-			}
-			if len(arr) > 1 {
-				if topic, ok := arr[1].(string); ok {
-					msg.Topic = topic
-				}
-			}
-			if len(arr) > 2 {
-				msg.Data = arr[2]
-			}
-			if len(arr) > 3 {
-				if id, ok := arr[3].(string); ok {
-					msg.ID = id
-				}
-			}
-			if len(arr) > 4 {
-				if to, ok := arr[4].(string); ok {
-					msg.To = to
-				}
-			}
-			if len(arr) > 5 {
-				switch code := arr[5].(type) {
-				case float64:
-					msg.Code = int(code)
-				case int:
-					msg.Code = code
-				}
-			}
-			s.handleUnifiedMessage(socket, msg)
-			return
-		}
+// handleReadError records why reading from the connection stopped
+func (s *Server) handleReadError(socket *Socket, err error) {
+	if closeErr, ok := err.(*CloseError); ok {
+		// A close from the client has already been echoed; for a
+		// protocol violation this tells the client why it is dropped
+		socket.conn.writeClose(closeErr.Code, closeErr.Reason)
+		socket.setCloseStatus(closeErr.Code, closeErr.Reason)
+	} else {
+		log.Println("Read frame error:", err)
+		socket.setCloseStatus(CloseAbnormalClosure, "")
+	}
+}
 
-		// Check if it's an object (compact or legacy format)
-		if obj, ok := jsonValue.(map[string]interface{}); ok {
-			// Unified/compact format (has 't' field)
-			if t, hasT := obj["t"]; hasT {
-				var msg Message
-				switch tv := t.(type) {
-				case float64:
-					msg.T = int(tv)
-				case int:
-					msg.T = tv
-				}
-				if topic, ok := obj["topic"].(string); ok {
-					msg.Topic = topic
-				}
-				if data, exists := obj["data"]; exists {
-					msg.Data = data
-				}
-				if id, ok := obj["id"].(string); ok {
-					msg.ID = id
-				}
-				if to, ok := obj["to"].(string); ok {
-					msg.To = to
-				}
-				if topic, ok := obj["topic"].(string); ok {
-					msg.Topic = topic
-				}
-				if code, ok := obj["code"].(float64); ok {
-					msg.Code = int(code)
-				}
-				// Handle file-specific fields
-				if filename, ok := obj["filename"].(string); ok {
-					if msg.Data == nil {
-						msg.Data = make(map[string]interface{})
-					}
-					if dataMap, ok := msg.Data.(map[string]interface{}); ok {
-						dataMap["filename"] = filename
-					}
-				}
-				if size, ok := obj["size"].(float64); ok {
-					if msg.Data == nil {
-						msg.Data = make(map[string]interface{})
-					}
-					if dataMap, ok := msg.Data.(map[string]interface{}); ok {
-						dataMap["size"] = int64(size)
-					}
-				}
-				s.handleUnifiedMessage(socket, msg)
-				return
-			}
+// finishConnection tears a connection down once reading has stopped
+func (s *Server) finishConnection(socket *Socket) {
+	socket.conn.conn.Close()
+	// Signal writer to stop
+	close(socket.conn.closeChan)
+	socket.cancel()
+	// Send empty message to unblock writer
+	select {
+	case socket.conn.writeChan <- outboundMessage{}:
+	default:
+	}
+	s.hub.RemoveSocket(socket.ID)
+	s.hub.triggerHandlers("close", socket)
+}
 
-			// Legacy format (has 'event' field)
-			if event, hasEvent := obj["event"]; hasEvent {
-				if eventStr, ok := event.(string); ok {
-					msg := Message{
-						T: stringToMsgType(eventStr),
-					}
-					if topic, ok := obj["topic"].(string); ok {
-						msg.Topic = topic
-					}
-					if data, exists := obj["data"]; exists {
-						msg.Data = data
-					}
-					if id, ok := obj["id"].(string); ok {
-						msg.ID = id
-					}
-					s.handleUnifiedMessage(socket, msg)
-					return
-				}
-			}
+// handleMessage decodes an incoming message with the socket's codec
+func (s *Server) handleMessage(socket *Socket, payload []byte) {
+	msg, err := socket.conn.messageCodec().Decode(payload)
+	if err != nil {
+		log.Printf("Undecodable message from %s (%s): %v", socket.ID, socket.conn.subprotocol, err)
+		if socket.conn.subprotocol != "" {
+			socket.SendMessage(Message{
+				T:    MsgError,
+				Data: map[string]string{"message": "invalid message for subprotocol " + socket.conn.subprotocol},
+			})
 		}
+		return
 	}
-
-	// Fallback to simple text protocol
-	s.handleTextMessage(socket, message)
+	s.handleUnifiedMessage(socket, msg, payload)
 }
 
-// handleUnifiedMessage handles unified Message format
-func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
-	// Trigger event handler based on message type
-	eventName := msgTypeToString(msg.T)
+// handleUnifiedMessage passes a decoded message through the inbound
+// middleware to its handlers and the built-in routing
+func (s *Server) handleUnifiedMessage(socket *Socket, msg Message, payload []byte) {
+	eventName := s.hub.MessageTypeName(msg.T)
 	log.Printf("Received message: type=%d (%s), socket=%s", msg.T, eventName, socket.ID)
-	s.hub.triggerHandlers(eventName, socket)
+	ctx := &Context{
+		Context: socket.ctx,
+		Socket:  socket,
+		Message: msg,
+		Payload: payload,
+		Event:   eventName,
+	}
+	s.hub.handleInbound(ctx, s.handleEvent)
+}
+
+// handleEvent runs the handlers of a message that passed the middleware,
+// then routes it. A reply to a Request is handed to the waiting request
+// instead.
+func (s *Server) handleEvent(ctx *Context) error {
+	if ctx.Socket.resolveReply(ctx.Message) {
+		return nil
+	}
+
+	// Middleware may have changed the type
+	mt, registered := s.hub.LookupMessageType(ctx.Message.T)
+	if !registered {
+		return &Error{Code: ErrorCodeUnknownType, Message: fmt.Sprintf("unknown message type %d", ctx.Message.T)}
+	}
+	ctx.Event = mt.Name
+	data, err := mt.decodePayload(ctx.Message.Data)
+	if err != nil {
+		return err
+	}
+	ctx.Message.Data = data
+
+	s.hub.triggerHandlers(ctx.Event, ctx.Socket)
+	handled, err := s.hub.runHandlers(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case mt.Handler != nil:
+		err = mt.Handler(ctx)
+	case mt.builtin || !handled:
+		// Application types handled by OnEvent or Handle are not routed
+		err = s.route(ctx)
+	}
+	if err != nil {
+		return err
+	}
 
+	// A message asking for an ack is answered even without a reply
+	if ctx.Message.Ack && !ctx.replied {
+		ctx.ack(map[string]string{"status": "received"})
+	}
+	return nil
+}
+
+// route handles a message according to its type
+func (s *Server) route(ctx *Context) error {
+	socket, msg := ctx.Socket, ctx.Message
 	switch msg.T {
 	case MsgSubscribe:
-		// Handle subscription
-		socket.conn.Subscribe(msg.Topic)
-		response := Message{
-			T:    MsgAck,
-			Data: map[string]string{"action": "subscribed", "topic": msg.Topic},
+		// Handle subscription; the topic may be a wildcard filter
+		if err := socket.Subscribe(msg.Topic); err != nil {
+			ctx.Reply(Message{
+				T:    MsgError,
+				Data: map[string]string{"message": err.Error(), "topic": msg.Topic},
+			})
+			return nil
 		}
-		socket.SendMessage(response)
+		ctx.ack(map[string]string{"action": "subscribed", "topic": msg.Topic})
 
 		// Broadcast updated topic list to all users
 		allTopics := s.hub.GetAllTopics()
@@ -410,12 +603,8 @@ func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
 
 	case MsgUnsubscribe:
 		// Handle unsubscription
-		socket.conn.Unsubscribe(msg.Topic)
-		response := Message{
-			T:    MsgAck,
-			Data: map[string]string{"action": "unsubscribed", "topic": msg.Topic},
-		}
-		socket.SendMessage(response)
+		socket.Unsubscribe(msg.Topic)
+		ctx.ack(map[string]string{"action": "unsubscribed", "topic": msg.Topic})
 
 		// Broadcast updated topic list to all users
 		allTopics := s.hub.GetAllTopics()
@@ -429,13 +618,28 @@ func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
 		s.hub.BroadcastMessage(topicListMsg)
 
 	case MsgBroadcast:
+		// Wildcards only make sense in subscriptions, not in publishes
+		if msg.Topic != "" {
+			if err := validateTopic(msg.Topic); err != nil {
+				ctx.Reply(Message{
+					T:    MsgError,
+					Data: map[string]string{"message": err.Error(), "topic": msg.Topic},
+				})
+				return nil
+			}
+		}
+
 		// Broadcast to all clients (excluding sender)
 		broadcastMsg := Message{
 			T:     MsgBroadcast,
 			Topic: msg.Topic,
 			Data:  msg.Data,
+			ID:    s.hub.NewID(),
 		}
-		s.hub.BroadcastMessageExcept(broadcastMsg, socket)
+		recipients := s.hub.broadcastMessageExcept(broadcastMsg, socket)
+		// The ack reports how many sockets the broadcast was queued for;
+		// it does not confirm that they received it
+		ctx.ack(map[string]interface{}{"status": "queued", "recipients": recipients})
 
 	case MsgPing:
 		// Respond to ping
@@ -443,12 +647,21 @@ func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
 			T:    MsgPong,
 			Data: map[string]int64{"timestamp": time.Now().Unix()},
 		}
-		socket.SendMessage(pongMsg)
+		ctx.Reply(pongMsg)
 
 	case MsgFile:
 		// Set pending file metadata for next binary message
 		socket.pendingFile = &msg
 
+		// Binary codecs carry the file bytes inline since binary frames
+		// are reserved for messages on those connections
+		if dataMap, ok := msg.Data.(map[string]interface{}); ok {
+			if content, ok := dataMap[FileContentKey].([]byte); ok {
+				delete(dataMap, FileContentKey)
+				s.handleBinaryMessage(socket, content)
+			}
+		}
+
 	case MsgTyping:
 		// Broadcast typing status to all other clients
 		typingMsg := Message{
@@ -467,22 +680,26 @@ func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
 				T:    MsgDirect,
 				Data: msg.Data,
 				From: socket.GetAlias(),
-				ID:   generateMessageID(),
-			}
-			targetSocket := s.hub.GetSocket(msg.To)
-			if targetSocket != nil {
-				targetSocket.SendMessage(directMsg)
+				ID:   s.hub.NewID(),
 			}
+			// To is a socket ID or a user ID, whose sockets all get the
+			// message, or who gets it on their next connection
+			s.hub.EmitMessage(msg.To, directMsg)
 		}
 
 	case MsgThread:
-		// Handle threaded message (reply)
+		// Handle threaded message (reply); one without a thread ID
+		// starts a new thread named by the message's own ID
+		id := s.hub.NewID()
+		if msg.ThreadID == "" && msg.ReplyTo == "" {
+			msg.ThreadID = id
+		}
 		if msg.ThreadID != "" {
 			threadMsg := Message{
 				T:        MsgThread,
 				Data:     msg.Data,
 				From:     socket.GetAlias(),
-				ID:       generateMessageID(),
+				ID:       id,
 				ThreadID: msg.ThreadID,
 				ReplyTo:  msg.ReplyTo,
 			}
@@ -504,89 +721,48 @@ func (s *Server) handleUnifiedMessage(socket *Socket, msg Message) {
 				"users": userList,
 			},
 		}
-		socket.SendMessage(userListMsg)
+		ctx.Reply(userListMsg)
 
 	case MsgSetAlias:
 		// Set user alias
-		if aliasData, ok := msg.Data.(map[string]interface{}); ok {
-			if alias, ok := aliasData["alias"].(string); ok && alias != "" {
-				socket.SetAlias(alias)
-				// Broadcast alias change to all users
-				aliasMsg := Message{
-					T: MsgSystem,
-					Data: map[string]interface{}{
-						"message": fmt.Sprintf("%s is now known as %s", socket.ID[:12], alias),
-						"type":    "alias_change",
-						"userId":  socket.ID,
-						"alias":   alias,
-					},
-				}
-				s.hub.BroadcastMessage(aliasMsg)
-
-				// Broadcast updated user list to all users
-				userList := s.hub.GetUserList()
-				userListMsg := Message{
-					T: MsgUserList,
-					Data: map[string]interface{}{
-						"users": userList,
-					},
-				}
-				s.hub.BroadcastMessage(userListMsg)
-			}
+		payload, err := DecodePayload[AliasPayload](msg.Data)
+		if err != nil {
+			return err
 		}
+		alias := payload.Alias
+		socket.SetAlias(alias)
+		// Broadcast alias change to all users
+		aliasMsg := Message{
+			T: MsgSystem,
+			Data: map[string]interface{}{
+				"message": fmt.Sprintf("%s is now known as %s", shortID(socket.ID), alias),
+				"type":    "alias_change",
+				"userId":  socket.ID,
+				"alias":   alias,
+			},
+		}
+		s.hub.BroadcastMessage(aliasMsg)
+
+		// Broadcast updated user list to all users
+		userList := s.hub.GetUserList()
+		userListMsg := Message{
+			T: MsgUserList,
+			Data: map[string]interface{}{
+				"users": userList,
+			},
+		}
+		s.hub.BroadcastMessage(userListMsg)
 
 	case MsgAuth, MsgJoin, MsgOffer, MsgAnswer, MsgIceCandidate, MsgMute, MsgUnmute, MsgHold, MsgDTMF:
 		// Handle WebRTC signaling messages
 		log.Printf("Routing WebRTC message to call manager: type=%d", msg.T)
 		if s.callManager != nil {
+			// The call manager answers requests itself
+			ctx.replied = true
 			s.callManager.HandleSignalingMessage(socket.ID, msg)
-		} else {
-			// Fallback to ack
-			ackMsg := Message{
-				T:    MsgAck,
-				Data: map[string]string{"status": "received"},
-			}
-			socket.SendMessage(ackMsg)
-		}
-
-	default:
-		log.Printf("Unknown message type: %d", msg.T)
-		// For unknown types, send ack
-		ackMsg := Message{
-			T:    MsgAck,
-			Data: map[string]string{"status": "received"},
-		}
-		socket.SendMessage(ackMsg)
-	}
-} // handleTextMessage handles simple text protocol
-func (s *Server) handleTextMessage(socket *Socket, message string) {
-	if strings.HasPrefix(message, "subscribe:") {
-		topic := strings.TrimPrefix(message, "subscribe:")
-		response := Message{
-			T:    MsgAck,
-			Data: map[string]string{"action": "subscribed", "topic": topic},
-		}
-		socket.SendMessage(response)
-	} else if strings.HasPrefix(message, "unsubscribe:") {
-		topic := strings.TrimPrefix(message, "unsubscribe:")
-		response := Message{
-			T:    MsgAck,
-			Data: map[string]string{"action": "unsubscribed", "topic": topic},
-		}
-		socket.SendMessage(response)
-	} else if strings.HasPrefix(message, "publish:") {
-		parts := strings.SplitN(message, ":", 3)
-		if len(parts) == 3 {
-			topic := parts[1]
-			data := parts[2]
-			broadcastMsg := Message{
-				T:     MsgBroadcast,
-				Topic: topic,
-				Data:  data,
-			}
-			s.hub.BroadcastMessageExcept(broadcastMsg, socket)
 		}
 	}
+	return nil
 }
 
 // handleBinaryMessage handles incoming binary data (files)
@@ -629,7 +805,7 @@ func (s *Server) handleBinaryMessage(socket *Socket, payload []byte) {
 		// Send to topic subscribers (excluding sender since they already know they sent it)
 		fileMsg.Topic = socket.pendingFile.Topic
 		s.hub.BroadcastMessageExcept(fileMsg, socket) // This will filter by topic subscriptions
-		s.hub.BroadcastBinaryToAll(payload)           // For now, broadcast binary to all - could be optimized
+		s.hub.PublishBinary(fileMsg.Topic, payload, socket)
 		log.Printf("Broadcasted binary file to topic %s from %s", socket.pendingFile.Topic, socket.ID)
 	} else {
 		// Broadcast to all clients except sender (since they already know they sent it)
@@ -0,0 +1,110 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// Flusher is implemented by message storage that buffers writes, e.g. a
+// storage batching inserts into a database. Shutdown flushes it once every
+// connection has closed.
+type Flusher interface {
+	Flush() error
+}
+
+// SetReconnectHint sets the reason sent with the going-away close frame on
+// Shutdown, e.g. the address of another node or a retry delay for clients
+// to honour before reconnecting. It is truncated at a character boundary to
+// the 123 bytes a close frame allows.
+func (s *Server) SetReconnectHint(hint string) {
+	s.reconnectHint = hint
+}
+
+// beginUpgrade registers an upgrade in progress so Shutdown waits for it. It
+// returns false once Shutdown has been called.
+func (s *Server) beginUpgrade() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// goTracked runs fn in a goroutine that Shutdown waits for. The caller must be
+// inside a registered upgrade so the WaitGroup count is non-zero.
+func (s *Server) goTracked(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// rejectShutdown answers an upgrade attempted during shutdown
+func rejectShutdown(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+}
+
+// Shutdown gracefully stops the server: new upgrades are refused with 503,
+// every socket is sent a going-away close frame (1001) carrying the reconnect
+// hint once its queued messages have been written, and offline storage is
+// flushed after all connection goroutines have exited. If ctx expires first
+// the remaining connections are dropped and ctx.Err() is returned. The
+// netpoll poller is stopped in both cases.
+//
+// Shutdown does not stop the http.Server the handler is mounted on; call its
+// own Shutdown first so no new requests reach HandleWebSocket.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownMu.Lock()
+	s.shuttingDown = true
+	s.shutdownMu.Unlock()
+
+	sockets := s.hub.GetAllSockets()
+	log.Printf("Shutting down, closing %d connections", len(sockets))
+
+	// The close frame is queued behind pending messages so they are flushed
+	// before the handshake starts
+	closeFrame := outboundMessage{
+		messageType: CloseMessage,
+		data:        formatClosePayload(CloseGoingAway, s.reconnectHint),
+	}
+	for _, socket := range sockets {
+		select {
+		case socket.conn.writeChan <- closeFrame:
+			socket.conn.wakeWriter()
+		case <-socket.conn.closeChan:
+		case <-ctx.Done():
+		}
+	}
+
+	// The poller is stopped whether or not the connections drain in time
+	if s.poller != nil {
+		defer s.poller.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, socket := range s.hub.GetAllSockets() {
+			socket.conn.abort()
+		}
+		return ctx.Err()
+	}
+
+	if flusher, ok := s.hub.storage.(Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package ws
 
 import (
-	"fmt"
 	"sync"
 	"time"
 )
@@ -20,6 +19,7 @@ type InMemoryMessageStorage struct {
 	messages map[string][]StoredMessage
 	mu       sync.RWMutex
 	maxAge   time.Duration
+	ids      IDGenerator
 }
 
 // StoredMessage represents a message stored for offline delivery
@@ -38,16 +38,30 @@ func NewInMemoryMessageStorage(maxAge time.Duration) *InMemoryMessageStorage {
 	return &InMemoryMessageStorage{
 		messages: make(map[string][]StoredMessage),
 		maxAge:   maxAge,
+		ids:      UUIDv7Generator{},
 	}
 }
 
+// SetIDGenerator replaces the generator of IDs for messages stored without
+// one. Hub.SetIDGenerator passes the hub's generator on to its storage.
+func (s *InMemoryMessageStorage) SetIDGenerator(gen IDGenerator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = gen
+}
+
 // StoreMessage stores a message for offline delivery
 func (s *InMemoryMessageStorage) StoreMessage(recipientID string, message Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// The stored ID must match the message ID the hub deletes by once the
+	// message has been delivered
+	if message.ID == "" {
+		message.ID = s.ids.NewID()
+	}
 	storedMsg := StoredMessage{
-		ID:        generateMessageID(),
+		ID:        message.ID,
 		Recipient: recipientID,
 		Message:   message,
 		Timestamp: time.Now(),
@@ -142,8 +156,3 @@ func (s *InMemoryMessageStorage) Close() error {
 	s.messages = make(map[string][]StoredMessage)
 	return nil
 }
-
-// generateMessageID generates a unique message ID
-func generateMessageID() string {
-	return fmt.Sprintf("msg_%d", time.Now().UnixNano())
-}
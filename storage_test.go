@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sequentialIDs returns an IDGenerator producing "id-1", "id-2", ...
+func sequentialIDs() IDGenerator {
+	n := 0
+	return IDGeneratorFunc(func() string {
+		n++
+		return fmt.Sprintf("id-%d", n)
+	})
+}
+
+func TestStoredMessageIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		store  func(h *Hub)
+		wantID string
+	}{
+		{
+			name:   "emitted to offline user",
+			store:  func(h *Hub) { h.EmitMessageToUser("bob", Message{T: MsgDirect, Data: "hi"}) },
+			wantID: "id-1",
+		},
+		{
+			name:   "binary emitted to offline user",
+			store:  func(h *Hub) { h.EmitBinaryToUser("bob", []byte("file")) },
+			wantID: "id-1",
+		},
+		{
+			name: "stored without an ID",
+			store: func(h *Hub) {
+				if err := h.Storage().StoreMessage("bob", Message{T: MsgDirect}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantID: "id-1",
+		},
+		{
+			name: "stored with an ID",
+			store: func(h *Hub) {
+				if err := h.Storage().StoreMessage("bob", Message{T: MsgDirect, ID: "mine"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantID: "mine",
+		},
+	}
+	for _, tt := range tests {
+		h := NewHub(nil)
+		h.SetIDGenerator(sequentialIDs())
+		tt.store(h)
+
+		stored, err := h.Storage().GetMessages("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 || stored[0].ID != tt.wantID {
+			t.Errorf("%s: stored %+v, want one message with ID %q", tt.name, stored, tt.wantID)
+			continue
+		}
+
+		// Delivery deletes the message by the ID it was stored under
+		socket := testSocket(h)
+		socket.SetIdentity(&Identity{UserID: "bob"})
+		if got := len(sentMessages(t, socket)); got != 1 {
+			t.Errorf("%s: delivered %d messages, want 1", tt.name, got)
+		}
+		if left, _ := h.Storage().GetMessages("bob"); len(left) != 0 {
+			t.Errorf("%s: %d messages left after delivery", tt.name, len(left))
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var errInvalidMessageType = errors.New("websocket: message type must be TextMessage or BinaryMessage")
+
+// NextReader returns the next data message as a stream, so a large payload
+// can be processed without holding it in memory. Control frames are handled
+// along the way as by ReadMessage, also between the fragments of the
+// message. Text messages are validated as UTF-8 while they are read and size
+// limits apply as for ReadMessage.
+//
+// The reader is valid until the next call to NextReader or ReadMessage, which
+// discard whatever was left unread. It must not be used concurrently with
+// other reads.
+func (c *Connection) NextReader() (messageType int, r io.Reader, err error) {
+	if err := c.discardStream(); err != nil {
+		return 0, nil, err
+	}
+
+	for {
+		hdr, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if isControl(hdr.opcode) {
+			data, err := c.readControlPayload(hdr)
+			if err != nil {
+				return 0, nil, err
+			}
+			if err := c.handleControl(hdr.opcode, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if hdr.opcode == ContinuationFrame {
+			return 0, nil, errUnexpectedContinuation
+		}
+		if c.maxMessageSize > 0 && hdr.length > c.maxMessageSize {
+			return 0, nil, errMessageTooLarge
+		}
+
+		m := &c.stream
+		*m = messageReader{
+			c:          c,
+			frames:     frameReader{c: c},
+			text:       hdr.opcode == TextMessage,
+			compressed: hdr.rsv1,
+		}
+		m.frames.start(hdr)
+		m.r = &m.frames
+		if hdr.rsv1 {
+			if m.r, err = c.deflate.inflater(&m.frames); err != nil {
+				return 0, nil, err
+			}
+		}
+		c.streaming = true
+		return int(hdr.opcode), m, nil
+	}
+}
+
+// discardStream reads and drops what is left of the message returned by the
+// last NextReader, so the next message starts on a frame boundary
+func (c *Connection) discardStream() error {
+	if !c.streaming {
+		return nil
+	}
+	c.streaming = false
+	if c.stream.err == io.EOF {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, &c.stream)
+	return err
+}
+
+// NextWriter returns a writer for a new text or binary message. Written data
+// is sent as a sequence of fragments, compressed when permessage-deflate was
+// negotiated, and the message is completed by Close. No other message can be
+// written on the connection until then.
+func (c *Connection) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, errInvalidMessageType
+	}
+	w := c.newMessageWriter(byte(messageType))
+	if w.err != nil {
+		err := w.err
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// messageReader streams one data message for NextReader
+type messageReader struct {
+	c          *Connection
+	frames     frameReader
+	r          io.Reader // frames, or the inflater reading them
+	text       bool
+	compressed bool
+	utf8       utf8Checker
+	n          int64
+	err        error
+}
+
+func (m *messageReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if limit := m.c.maxMessageSize; limit > 0 && m.n > limit {
+		m.err = errMessageTooLarge
+		return 0, m.err
+	}
+	if m.compressed && err != nil && err != io.EOF {
+		err = inflateError(err)
+	}
+	if m.text && (!m.utf8.check(p[:n]) || err == io.EOF && !m.utf8.complete()) {
+		err = errInvalidUTF8
+	}
+	if err != nil {
+		m.err = err
+	}
+	return n, err
+}
+
+// frameReader reads the payload of a data frame and its continuation frames,
+// unmasking it in place and handling interleaved control frames
+type frameReader struct {
+	c         *Connection
+	remaining int64
+	total     int64
+	fin       bool
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	err       error
+}
+
+// start begins reading the payload of the frame described by hdr
+func (r *frameReader) start(hdr frameHeader) {
+	r.remaining = hdr.length
+	r.total += hdr.length
+	r.fin = hdr.fin
+	r.masked = hdr.masked
+	r.maskKey = hdr.maskKey
+	r.maskPos = 0
+}
+
+// more advances to the next frame with unread payload. It returns io.EOF at
+// the end of the message.
+func (r *frameReader) more() error {
+	if r.err != nil {
+		return r.err
+	}
+	for r.remaining == 0 {
+		if r.fin {
+			return io.EOF
+		}
+		if err := r.nextFrame(); err != nil {
+			r.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// nextFrame reads frame headers up to the next continuation frame
+func (r *frameReader) nextFrame() error {
+	c := r.c
+	for {
+		hdr, err := c.readFrameHeader()
+		if err != nil {
+			return err
+		}
+		if isControl(hdr.opcode) {
+			data, err := c.readControlPayload(hdr)
+			if err != nil {
+				return err
+			}
+			if err := c.handleControl(hdr.opcode, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if hdr.opcode != ContinuationFrame {
+			return errExpectedContinuation
+		}
+		if c.maxMessageSize > 0 && r.total+hdr.length > c.maxMessageSize {
+			return errMessageTooLarge
+		}
+		r.start(hdr)
+		return nil
+	}
+}
+
+// consume unmasks bytes just read and refreshes the read deadline at the end
+// of each frame
+func (r *frameReader) consume(p []byte) {
+	if r.masked {
+		r.maskPos = maskBytes(r.maskKey, r.maskPos, p)
+	}
+	r.remaining -= int64(len(p))
+	if r.remaining == 0 {
+		r.c.refreshReadDeadline()
+	}
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if err := r.more(); err != nil {
+		return 0, err
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.c.reader.Read(p)
+	r.consume(p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *frameReader) ReadByte() (byte, error) {
+	if err := r.more(); err != nil {
+		return 0, err
+	}
+	b, err := r.c.reader.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	one := [1]byte{b}
+	r.consume(one[:])
+	return one[0], nil
+}
+
+// utf8Checker validates UTF-8 text that arrives in arbitrary chunks
+type utf8Checker struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// check validates p, carrying an incomplete rune at its end over to the
+// next call
+func (u *utf8Checker) check(p []byte) bool {
+	// Complete a rune left over from the previous chunk
+	for u.n > 0 && len(p) > 0 {
+		u.pending[u.n] = p[0]
+		u.n++
+		p = p[1:]
+		if utf8.FullRune(u.pending[:u.n]) {
+			if !utf8.Valid(u.pending[:u.n]) {
+				return false
+			}
+			u.n = 0
+		}
+	}
+	if u.n > 0 {
+		return true
+	}
+
+	// Hold back a rune cut off at the end of p
+	tail := 0
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				tail = len(p) - i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:len(p)-tail]) {
+		return false
+	}
+	u.n = copy(u.pending[:], p[len(p)-tail:])
+	return true
+}
+
+// complete reports whether no rune was left unfinished
+func (u *utf8Checker) complete() bool {
+	return u.n == 0
+}
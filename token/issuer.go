@@ -0,0 +1,150 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultTTL is how long issued tokens are valid unless configured otherwise
+const DefaultTTL = time.Hour
+
+// ErrInvalidCredentials is returned by a CredentialVerifier for a wrong
+// username or password
+var ErrInvalidCredentials = errors.New("token: invalid credentials")
+
+// IssuerOptions configures the registered claims of issued tokens
+type IssuerOptions struct {
+	// Issuer is set as the iss claim
+	Issuer string
+	// Audience is set as the aud claim when non-empty
+	Audience []string
+	// TTL is the lifetime of issued tokens and defaults to DefaultTTL
+	TTL time.Duration
+}
+
+// Issuer signs tokens with a single key. To rotate keys, publish the next
+// key in the verifiers' JWKS first, then switch the issuer to it.
+type Issuer struct {
+	key  Key
+	opts IssuerOptions
+	now  func() time.Time
+}
+
+// NewIssuer creates an issuer signing with key, which must hold a secret or
+// a private key
+func NewIssuer(key Key, opts IssuerOptions) (*Issuer, error) {
+	if !key.canSign() {
+		return nil, errors.New("token: issuer key has no secret or private key")
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	return &Issuer{key: key, opts: opts, now: time.Now}, nil
+}
+
+// Issue signs claims after filling in iss, aud, iat, exp and jti where they
+// are not set
+func (i *Issuer) Issue(claims Claims) (string, error) {
+	now := i.now()
+	if claims.Issuer == "" {
+		claims.Issuer = i.opts.Issuer
+	}
+	if len(claims.Audience) == 0 {
+		claims.Audience = i.opts.Audience
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = now.Unix()
+	}
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = now.Add(i.opts.TTL).Unix()
+	}
+	if claims.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		claims.ID = hex.EncodeToString(id)
+	}
+
+	hdr, err := encodeJSON(header{Alg: i.key.Algorithm, Typ: "JWT", Kid: i.key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeJSON(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := hdr + "." + payload
+	signature, err := sign(i.key, signed)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + encodeSegment(signature), nil
+}
+
+// Credentials are submitted to the token endpoint
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Room requests a token scoped to a call room
+	Room string `json:"room,omitempty"`
+}
+
+// CredentialVerifier checks submitted credentials and returns the claims of
+// the token to issue, at least the subject. It returns ErrInvalidCredentials
+// for a wrong username or password.
+type CredentialVerifier interface {
+	VerifyCredentials(ctx context.Context, creds Credentials) (*Claims, error)
+}
+
+// CredentialVerifierFunc adapts a function to a CredentialVerifier
+type CredentialVerifierFunc func(ctx context.Context, creds Credentials) (*Claims, error)
+
+func (f CredentialVerifierFunc) VerifyCredentials(ctx context.Context, creds Credentials) (*Claims, error) {
+	return f(ctx, creds)
+}
+
+// Handler returns the token endpoint: it accepts credentials as a JSON POST
+// body, checks them with verifier and answers with a signed token
+func (i *Issuer) Handler(verifier CredentialVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+
+		var creds Credentials
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&creds); err != nil {
+			http.Error(w, "Invalid request body", 400)
+			return
+		}
+
+		claims, err := verifier.VerifyCredentials(r.Context(), creds)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				log.Printf("Credential verification failed for %q: %v", creds.Username, err)
+			}
+			http.Error(w, "Invalid credentials", 401)
+			return
+		}
+
+		token, err := i.Issue(*claims)
+		if err != nil {
+			log.Printf("Token issuance failed for %q: %v", creds.Username, err)
+			http.Error(w, "Token issuance failed", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      token,
+			"token_type": "Bearer",
+			"expires_in": int(i.opts.TTL / time.Second),
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// Supported signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Key is a key of a single algorithm, identified by its key ID. Verification
+// needs the secret or public key; issuing needs the secret or private key.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	public  crypto.PublicKey
+	private crypto.Signer
+}
+
+// HMACKey returns an HS256 key for a shared secret
+func HMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Algorithm: HS256, secret: secret}
+}
+
+// SignerKey returns an RS256 or ES256 key for an RSA or P-256 private key,
+// e.g. one loaded with LoadPrivateKey
+func SignerKey(id string, signer crypto.Signer) (Key, error) {
+	key, err := publicKey(id, signer.Public())
+	if err != nil {
+		return Key{}, err
+	}
+	key.private = signer
+	return key, nil
+}
+
+// publicKey returns a verification key for an RSA or P-256 public key
+func publicKey(id string, public crypto.PublicKey) (Key, error) {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		return Key{ID: id, Algorithm: RS256, public: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return Key{}, fmt.Errorf("token: unsupported curve %s", k.Curve.Params().Name)
+		}
+		return Key{ID: id, Algorithm: ES256, public: k}, nil
+	}
+	return Key{}, fmt.Errorf("token: unsupported key type %T", public)
+}
+
+// Public returns the key without its private part, e.g. to add the key an
+// issuer signs with to a verifier's key set
+func (k Key) Public() Key {
+	k.private = nil
+	return k
+}
+
+// canSign reports whether the key holds the material needed to issue tokens
+func (k Key) canSign() bool {
+	return len(k.secret) > 0 || k.private != nil
+}
+
+// LoadPrivateKey reads an RSA or P-256 private key from a PEM file in PKCS#8,
+// PKCS#1 or SEC 1 form
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("token: no PEM data in %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("token: unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// KeySet holds the keys tokens are verified with. Keys can be rotated by
+// replacing the set, e.g. by reloading a JWKS file: tokens signed with a key
+// that is still listed keep verifying while new ones use the next key.
+type KeySet struct {
+	mu   sync.RWMutex
+	keys []Key
+	path string
+	mod  time.Time
+}
+
+// NewKeySet creates a key set holding keys
+func NewKeySet(keys ...Key) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// LoadJWKS creates a key set from a local JWKS file (RFC 7517). Reload and
+// Watch pick up changes to the file.
+func LoadJWKS(path string) (*KeySet, error) {
+	ks := &KeySet{path: path}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Add adds a key to the set, replacing a key with the same ID
+func (ks *KeySet) Add(key Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for i := range ks.keys {
+		if ks.keys[i].ID == key.ID {
+			ks.keys[i] = key
+			return
+		}
+	}
+	ks.keys = append(ks.keys, key)
+}
+
+// Key returns the key with the given ID
+func (ks *KeySet) Key(id string) (Key, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// candidates returns the keys a token may have been signed with: the key
+// named by kid, or every key of the algorithm when the token names none
+func (ks *KeySet) candidates(kid, alg string) []Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	var keys []Key
+	for _, key := range ks.keys {
+		if key.Algorithm == alg && (kid == "" || key.ID == kid) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Reload re-reads the JWKS file the set was loaded from. On error the
+// current keys are kept.
+func (ks *KeySet) Reload() error {
+	if ks.path == "" {
+		return nil
+	}
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ks.path, err)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.mod = info.ModTime()
+	return nil
+}
+
+// Watch reloads the JWKS file whenever its modification time changes,
+// checking every interval until ctx is done
+func (ks *KeySet) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(ks.path)
+		if err != nil {
+			log.Printf("JWKS watch: %v", err)
+			continue
+		}
+		ks.mu.RLock()
+		changed := !info.ModTime().Equal(ks.mod)
+		ks.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := ks.Reload(); err != nil {
+			log.Printf("JWKS reload failed, keeping current keys: %v", err)
+			continue
+		}
+		log.Printf("JWKS reloaded from %s", ks.path)
+	}
+}
+
+// jwk is a JSON Web Key (RFC 7517/7518) of type oct, RSA or EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+
+	// oct
+	K string `json:"k,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	// Private exponent or scalar
+	D string `json:"d,omitempty"`
+}
+
+// ParseJWKS parses a JWKS document. Keys meant for encryption and keys of
+// unsupported types are skipped. A private EC key ("d") is kept so the set
+// can also be used to issue tokens; RSA keys are loaded as public keys only.
+func ParseJWKS(data []byte) ([]Key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make([]Key, 0, len(doc.Keys))
+	for _, j := range doc.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", j.Kid, err)
+		}
+		if key.Algorithm == "" {
+			continue
+		}
+		if j.Alg != "" && j.Alg != key.Algorithm {
+			return nil, fmt.Errorf("key %q: algorithm %s does not match key type %s", j.Kid, j.Alg, j.Kty)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// key decodes a JWK. Unsupported key types yield a Key without algorithm.
+func (j jwk) key() (Key, error) {
+	switch j.Kty {
+	case "oct":
+		secret, err := decodeSegment(j.K)
+		if err != nil || len(secret) == 0 {
+			return Key{}, errors.New("invalid secret")
+		}
+		return HMACKey(j.Kid, secret), nil
+
+	case "RSA":
+		n, err1 := decodeInt(j.N)
+		e, err2 := decodeInt(j.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() {
+			return Key{}, errors.New("invalid RSA key")
+		}
+		return publicKey(j.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())})
+
+	case "EC":
+		if j.Crv != "P-256" {
+			return Key{}, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err1 := decodeInt(j.X)
+		y, err2 := decodeInt(j.Y)
+		if err1 != nil || err2 != nil {
+			return Key{}, errors.New("invalid EC key")
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !public.Curve.IsOnCurve(x, y) {
+			return Key{}, errors.New("EC point is not on the curve")
+		}
+		if j.D == "" {
+			return publicKey(j.Kid, public)
+		}
+		d, err := decodeInt(j.D)
+		if err != nil {
+			return Key{}, errors.New("invalid EC private key")
+		}
+		return SignerKey(j.Kid, &ecdsa.PrivateKey{PublicKey: *public, D: d})
+	}
+	return Key{}, nil
+}
+
+// decodeSegment decodes unpadded base64url as used throughout JOSE
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := decodeSegment(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
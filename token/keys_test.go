@@ -0,0 +1,165 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rsaJWK returns the public JWK of an RSA key
+func rsaJWK(id string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": id, "alg": RS256, "n": b64(key.N.Bytes()), "e": b64([]byte{1, 0, 1})}
+}
+
+// writeJWKS writes a JWKS document holding keys to path
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		keys    []map[string]string
+		wantIDs []string
+	}{
+		{"oct", []map[string]string{{"kty": "oct", "kid": "h", "k": b64([]byte("secret"))}}, []string{"h"}},
+		{"RSA", []map[string]string{rsaJWK("r", rsaPrivate)}, []string{"r"}},
+		{"encryption key skipped", []map[string]string{{"kty": "RSA", "use": "enc", "kid": "x"}, rsaJWK("r", rsaPrivate)}, []string{"r"}},
+		{"unsupported type skipped", []map[string]string{{"kty": "OKP", "kid": "o"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(map[string]any{"keys": tt.keys})
+			keys, err := ParseJWKS(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tt.wantIDs) {
+				t.Fatalf("got %d keys, want %d", len(keys), len(tt.wantIDs))
+			}
+			for i, key := range keys {
+				if key.ID != tt.wantIDs[i] {
+					t.Errorf("key %d: ID = %q, want %q", i, key.ID, tt.wantIDs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestJWKSReload(t *testing.T) {
+	var signers []Key
+	var jwks []map[string]string
+	for _, id := range []string{"old", "new"} {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := SignerKey(id, private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, key)
+		jwks = append(jwks, rsaJWK(id, private))
+	}
+	tokens := make([]string, len(signers))
+	for i, key := range signers {
+		issuer, err := NewIssuer(key, IssuerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens[i], err = issuer.Issue(Claims{Subject: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, jwks[0])
+	set, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVerifier(set, VerifierOptions{})
+
+	// Each step rewrites the file and reloads it, rotating from the old key
+	// to the new one
+	steps := []struct {
+		name    string
+		keys    []map[string]string
+		corrupt bool
+		wantErr [2]error
+	}{
+		{"old key only", []map[string]string{jwks[0]}, false, [2]error{nil, ErrUnknownKey}},
+		{"both keys", []map[string]string{jwks[0], jwks[1]}, false, [2]error{nil, nil}},
+		{"new key only", []map[string]string{jwks[1]}, false, [2]error{ErrUnknownKey, nil}},
+		{"invalid file keeps keys", nil, true, [2]error{ErrUnknownKey, nil}},
+	}
+	for _, step := range steps {
+		if step.corrupt {
+			if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := set.Reload(); err == nil {
+				t.Fatalf("%s: Reload succeeded on an invalid file", step.name)
+			}
+		} else {
+			writeJWKS(t, path, step.keys...)
+			if err := set.Reload(); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		for i, tok := range tokens {
+			if _, err := v.Verify(tok); err != step.wantErr[i] {
+				t.Errorf("%s: token of %q: error = %v, want %v", step.name, signers[i].ID, err, step.wantErr[i])
+			}
+		}
+	}
+}
+
+func TestJWKSWatch(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path)
+	set, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go set.Watch(ctx, 5*time.Millisecond)
+
+	// Make sure the modification time differs from the initial load
+	writeJWKS(t, path, rsaJWK("r", private))
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := set.Key("r"); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Watch did not pick up the new key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
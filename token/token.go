@@ -0,0 +1,304 @@
+// Package token issues and verifies the JSON Web Tokens (RFC 7519) clients
+// present to the WebSocket server, signed with HS256, RS256 or ES256.
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oarkflow/ws"
+)
+
+var (
+	// ErrMalformed is returned for tokens that are not a valid signed JWT
+	ErrMalformed = errors.New("token: malformed token")
+	// ErrUnsupportedAlgorithm is returned for algorithms other than HS256,
+	// RS256 and ES256, including "none"
+	ErrUnsupportedAlgorithm = errors.New("token: unsupported algorithm")
+	// ErrUnknownKey is returned when no key of the token's key ID and
+	// algorithm is known
+	ErrUnknownKey = errors.New("token: unknown signing key")
+	// ErrInvalidSignature is returned when the signature does not verify
+	ErrInvalidSignature = errors.New("token: invalid signature")
+	// ErrExpired is returned for tokens past their exp claim
+	ErrExpired = errors.New("token: expired")
+	// ErrMissingExpiry is returned for tokens without an exp claim unless
+	// VerifierOptions.AllowNoExpiry is set
+	ErrMissingExpiry = errors.New("token: missing expiry")
+	// ErrNotYetValid is returned for tokens before their nbf claim
+	ErrNotYetValid = errors.New("token: not yet valid")
+	// ErrInvalidIssuer is returned when the iss claim does not match
+	ErrInvalidIssuer = errors.New("token: invalid issuer")
+	// ErrInvalidAudience is returned when the aud claim does not include
+	// the expected audience
+	ErrInvalidAudience = errors.New("token: invalid audience")
+	// ErrMissingSubject is returned for tokens without a sub claim
+	ErrMissingSubject = errors.New("token: missing subject")
+)
+
+// Claims are the registered claims checked by a Verifier plus the custom
+// claims scoping a token to a call room and role
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+
+	// Name is the display name of the user
+	Name string `json:"name,omitempty"`
+	// Room restricts the token to a single call room when set
+	Room string `json:"room,omitempty"`
+	// Role is the participant role in call rooms, e.g. "host", "moderator"
+	// or "participant"
+	Role string `json:"role,omitempty"`
+}
+
+// Audience is the aud claim, which is either a single string or an array
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Identity converts the claims to the identity attached to a socket. The
+// subject becomes the user ID; the claims are kept under their JSON names.
+func (c *Claims) Identity() *ws.Identity {
+	claims := map[string]interface{}{}
+	data, _ := json.Marshal(c)
+	json.Unmarshal(data, &claims)
+	return &ws.Identity{UserID: c.Subject, Claims: claims}
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// VerifierOptions configures the claim checks of a Verifier
+type VerifierOptions struct {
+	// Issuer is the required iss claim when set
+	Issuer string
+	// Audience must be listed in the aud claim when set
+	Audience string
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway time.Duration
+	// AllowNoExpiry accepts tokens without an exp claim, which are
+	// otherwise rejected with ErrMissingExpiry
+	AllowNoExpiry bool
+}
+
+// Verifier verifies tokens against a key set
+type Verifier struct {
+	keys *KeySet
+	opts VerifierOptions
+	now  func() time.Time
+}
+
+// NewVerifier creates a verifier accepting tokens signed with any key in keys
+func NewVerifier(keys *KeySet, opts VerifierOptions) *Verifier {
+	return &Verifier{keys: keys, opts: opts, now: time.Now}
+}
+
+// Verify checks the signature and the exp, nbf, iss and aud claims of a
+// token and returns its claims
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var hdr header
+	if err := decodeJSON(parts[0], &hdr); err != nil {
+		return nil, ErrMalformed
+	}
+	if hdr.Alg != HS256 && hdr.Alg != RS256 && hdr.Alg != ES256 {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	// Keys are matched on the header's algorithm as well as its key ID, so
+	// a public RSA key can never be used as an HMAC secret
+	keys := v.keys.candidates(hdr.Kid, hdr.Alg)
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+	verified := false
+	for _, key := range keys {
+		if verify(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// checkClaims validates the registered claims
+func (v *Verifier) checkClaims(c *Claims) error {
+	now := v.now()
+	if c.ExpiresAt == 0 && !v.opts.AllowNoExpiry {
+		return ErrMissingExpiry
+	}
+	if c.ExpiresAt != 0 && !now.Before(time.Unix(c.ExpiresAt, 0).Add(v.opts.Leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(v.opts.Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrNotYetValid
+	}
+	if v.opts.Issuer != "" && c.Issuer != v.opts.Issuer {
+		return ErrInvalidIssuer
+	}
+	if v.opts.Audience != "" && !slices.Contains(c.Audience, v.opts.Audience) {
+		return ErrInvalidAudience
+	}
+	if c.Subject == "" {
+		return ErrMissingSubject
+	}
+	return nil
+}
+
+// Identity verifies a token and returns the identity it carries. It can be
+// used as the token validator of the call manager.
+func (v *Verifier) Identity(token string) (*ws.Identity, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Identity(), nil
+}
+
+// Authenticate verifies the bearer token of a WebSocket handshake. It can be
+// used as the server's Authenticator; handshakes without a valid token are
+// rejected with 401.
+func (v *Verifier) Authenticate(r *http.Request) (*ws.Identity, error) {
+	token := ws.BearerToken(r)
+	if token == "" {
+		return nil, &ws.AuthError{Status: http.StatusUnauthorized, Message: "Missing token"}
+	}
+	identity, err := v.Identity(token)
+	if err != nil {
+		return nil, &ws.AuthError{Status: http.StatusUnauthorized, Message: err.Error()}
+	}
+	return identity, nil
+}
+
+// sign signs the header and claims segments with key
+func sign(key Key, signed string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(signed))
+	switch key.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil), nil
+
+	case RS256:
+		return key.private.Sign(rand.Reader, sum[:], crypto.SHA256)
+
+	case ES256:
+		// JWS uses the fixed-size r || s encoding rather than ASN.1
+		ecKey, ok := key.private.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// verify checks a signature made with key
+func verify(key Key, signed string, signature []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+	switch key.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(signature, mac.Sum(nil))
+
+	case RS256:
+		public, ok := key.public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(public, crypto.SHA256, sum[:], signature) == nil
+
+	case ES256:
+		public, ok := key.public.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, sum[:], r, s)
+	}
+	return false
+}
+
+// encodeJSON encodes v as a base64url token segment
+func encodeJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return encodeSegment(data), nil
+}
+
+// encodeSegment encodes unpadded base64url
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeJSON decodes a base64url token segment into v
+func decodeJSON(segment string, v any) error {
+	data, err := decodeSegment(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
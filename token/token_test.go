@@ -0,0 +1,173 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+// signHS256 builds an HS256 token with an arbitrary header and claims,
+// bypassing the checks of Issuer
+func signHS256(t *testing.T, secret []byte, header, claims map[string]any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(h) + "." + b64(c)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + b64(mac.Sum(nil))
+}
+
+func TestVerifyClaims(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	secret := []byte("secret")
+	header := map[string]any{"alg": HS256, "kid": "h"}
+	exp := now.Add(time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		opts    VerifierOptions
+		wantErr error
+	}{
+		{"valid", map[string]any{"sub": "alice", "exp": exp}, VerifierOptions{}, nil},
+		{"expired", map[string]any{"sub": "alice", "exp": now.Add(-time.Minute).Unix()}, VerifierOptions{}, ErrExpired},
+		{"expired within leeway", map[string]any{"sub": "alice", "exp": now.Add(-time.Minute).Unix()}, VerifierOptions{Leeway: 2 * time.Minute}, nil},
+		{"expires now", map[string]any{"sub": "alice", "exp": now.Unix()}, VerifierOptions{}, ErrExpired},
+		{"missing exp", map[string]any{"sub": "alice"}, VerifierOptions{}, ErrMissingExpiry},
+		{"missing exp allowed", map[string]any{"sub": "alice"}, VerifierOptions{AllowNoExpiry: true}, nil},
+		{"not yet valid", map[string]any{"sub": "alice", "exp": exp, "nbf": now.Add(time.Minute).Unix()}, VerifierOptions{}, ErrNotYetValid},
+		{"nbf within leeway", map[string]any{"sub": "alice", "exp": exp, "nbf": now.Add(time.Minute).Unix()}, VerifierOptions{Leeway: 2 * time.Minute}, nil},
+		{"issuer", map[string]any{"sub": "alice", "exp": exp, "iss": "me"}, VerifierOptions{Issuer: "me"}, nil},
+		{"wrong issuer", map[string]any{"sub": "alice", "exp": exp, "iss": "other"}, VerifierOptions{Issuer: "me"}, ErrInvalidIssuer},
+		{"audience string", map[string]any{"sub": "alice", "exp": exp, "aud": "app"}, VerifierOptions{Audience: "app"}, nil},
+		{"audience list", map[string]any{"sub": "alice", "exp": exp, "aud": []string{"x", "app"}}, VerifierOptions{Audience: "app"}, nil},
+		{"wrong audience", map[string]any{"sub": "alice", "exp": exp, "aud": []string{"x", "y"}}, VerifierOptions{Audience: "app"}, ErrInvalidAudience},
+		{"missing subject", map[string]any{"exp": exp}, VerifierOptions{}, ErrMissingSubject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(NewKeySet(HMACKey("h", secret)), tt.opts)
+			v.now = func() time.Time { return now }
+			_, err := v.Verify(signHS256(t, secret, header, tt.claims))
+			if err != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAlgorithmConfusion(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := SignerKey("r", rsaPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	claims := map[string]any{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()}
+	v := NewVerifier(NewKeySet(rsaKey.Public(), HMACKey("h", []byte("secret"))), VerifierOptions{})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"HS256 signed with the RSA public key", signHS256(t, publicPEM, map[string]any{"alg": HS256, "kid": "r"}, claims), ErrUnknownKey},
+		{"HS256 signed with the RSA modulus", signHS256(t, rsaPrivate.N.Bytes(), map[string]any{"alg": HS256, "kid": "r"}, claims), ErrUnknownKey},
+		{"HS256 without kid", signHS256(t, publicPEM, map[string]any{"alg": HS256}, claims), ErrInvalidSignature},
+		{"RS256 naming the HMAC key", signHS256(t, []byte("secret"), map[string]any{"alg": RS256, "kid": "h"}, claims), ErrUnknownKey},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"mallory"}`)) + ".", ErrUnsupportedAlgorithm},
+		{"alg None", b64([]byte(`{"alg":"None","kid":"r"}`)) + "." + b64([]byte(`{"sub":"mallory"}`)) + ".", ErrUnsupportedAlgorithm},
+		{"two segments", "a.b", ErrMalformed},
+		{"bad header", "!!!.e30.", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.Verify(tt.token); err != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIssueVerifyRoundTrip(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := SignerKey("r", rsaPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := SignerKey("e", ecPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := HMACKey("h", []byte("secret"))
+	v := NewVerifier(NewKeySet(hmacKey, rsaKey.Public(), ecKey.Public()), VerifierOptions{Issuer: "me", Audience: "app"})
+
+	tests := []struct {
+		name string
+		key  Key
+		alg  string
+	}{
+		{"HS256", hmacKey, HS256},
+		{"RS256", rsaKey, RS256},
+		{"ES256", ecKey, ES256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := NewIssuer(tt.key, IssuerOptions{Issuer: "me", Audience: []string{"app"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := issuer.Issue(Claims{Subject: "alice", Role: "host", Room: "r1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := v.Verify(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "alice" || claims.Role != "host" || claims.Room != "r1" || claims.ExpiresAt == 0 {
+				t.Fatalf("claims = %+v", claims)
+			}
+
+			// Swapping the claims must invalidate the signature
+			parts := strings.Split(tok, ".")
+			forged := parts[0] + "." + b64([]byte(`{"sub":"mallory","iss":"me","aud":"app","exp":9999999999}`)) + "." + parts[2]
+			if _, err := v.Verify(forged); err != ErrInvalidSignature {
+				t.Fatalf("forged token: error = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Topic wildcards, as in MQTT: "+" matches exactly one level and "#" matches
+// any number of levels, including none, at the end of a filter. Levels are
+// separated by "/", e.g. "orders/+/status" or "alerts/#".
+const (
+	topicSeparator      = "/"
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+)
+
+// ErrInvalidTopic is returned for malformed topic filters and for publishes
+// to a topic containing wildcards
+var ErrInvalidTopic = errors.New("websocket: invalid topic")
+
+// topicNode is a level of the subscription trie
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[*Socket]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[*Socket]struct{}),
+	}
+}
+
+// topicTree indexes topic filters level by level, so matching a publish
+// visits only the branches its levels and wildcards lead to
+type topicTree struct {
+	mu   sync.RWMutex
+	root *topicNode
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode()}
+}
+
+// validateFilter checks that wildcards occupy whole levels and that "#"
+// only appears last
+func validateFilter(filter string) error {
+	if filter == "" {
+		return ErrInvalidTopic
+	}
+	levels := strings.Split(filter, topicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == multiLevelWildcard && i != len(levels)-1:
+			return ErrInvalidTopic
+		case level != singleLevelWildcard && level != multiLevelWildcard &&
+			strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard):
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// validateTopic checks that a topic to publish to has no wildcards
+func validateTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// subscribe adds a socket under a filter and reports whether it was new
+func (t *topicTree) subscribe(filter string, socket *Socket) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node := t.root
+	for _, level := range strings.Split(filter, topicSeparator) {
+		child, exists := node.children[level]
+		if !exists {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	if _, exists := node.subscribers[socket]; exists {
+		return false
+	}
+	node.subscribers[socket] = struct{}{}
+	return true
+}
+
+// unsubscribe removes a socket from a filter, pruning branches left empty
+func (t *topicTree) unsubscribe(filter string, socket *Socket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	levels := strings.Split(filter, topicSeparator)
+	path := make([]*topicNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, exists := node.children[level]
+		if !exists {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	delete(node.subscribers, socket)
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.subscribers) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// match returns the sockets subscribed to a filter matching topic. A socket
+// matching several filters is returned once.
+func (t *topicTree) match(topic string) map[*Socket]struct{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	matched := make(map[*Socket]struct{})
+	levels := strings.Split(topic, topicSeparator)
+	// Topics starting with "$" are reserved and not matched by a wildcard
+	// in the first level
+	wildcards := !strings.HasPrefix(topic, "$")
+	t.root.match(levels, wildcards, matched)
+	return matched
+}
+
+func (n *topicNode) match(levels []string, wildcards bool, matched map[*Socket]struct{}) {
+	if wildcards {
+		// "#" also matches the parent level itself: "alerts/#" matches
+		// "alerts"
+		if child, exists := n.children[multiLevelWildcard]; exists {
+			for socket := range child.subscribers {
+				matched[socket] = struct{}{}
+			}
+		}
+	}
+	if len(levels) == 0 {
+		for socket := range n.subscribers {
+			matched[socket] = struct{}{}
+		}
+		return
+	}
+
+	if child, exists := n.children[levels[0]]; exists {
+		child.match(levels[1:], true, matched)
+	}
+	if wildcards {
+		if child, exists := n.children[singleLevelWildcard]; exists {
+			child.match(levels[1:], true, matched)
+		}
+	}
+}
+
+// filters returns every filter with at least one subscriber
+func (t *topicTree) filters() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var filters []string
+	var walk func(node *topicNode, prefix string)
+	walk = func(node *topicNode, prefix string) {
+		for level, child := range node.children {
+			filter := level
+			if prefix != "" {
+				filter = prefix + topicSeparator + level
+			}
+			if len(child.subscribers) > 0 {
+				filters = append(filters, filter)
+			}
+			walk(child, filter)
+		}
+	}
+	walk(t.root, "")
+	sort.Strings(filters)
+	return filters
+}
+
+// SetGlobalTopics sets the topics whose messages go to every socket rather
+// than to subscribers, replacing the default "general"
+func (h *Hub) SetGlobalTopics(topics ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.globalTopics = make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		h.globalTopics[topic] = true
+	}
+}
+
+// isGlobalTopic reports whether a topic is sent to every socket
+func (h *Hub) isGlobalTopic(topic string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.globalTopics[topic]
+}
+
+// Subscribe subscribes a socket to a topic filter, which may contain the
+// wildcards "+" and "#"
+func (h *Hub) Subscribe(socket *Socket, filter string) error {
+	if err := validateFilter(filter); err != nil {
+		return err
+	}
+	if !h.topics.subscribe(filter, socket) {
+		return nil
+	}
+
+	socket.mu.Lock()
+	socket.topics[filter] = struct{}{}
+	socket.mu.Unlock()
+
+	// A socket that disconnected meanwhile has already been unsubscribed
+	select {
+	case <-socket.conn.closeChan:
+		h.Unsubscribe(socket, filter)
+	default:
+	}
+	return nil
+}
+
+// Unsubscribe removes a socket's subscription to a topic filter
+func (h *Hub) Unsubscribe(socket *Socket, filter string) {
+	h.topics.unsubscribe(filter, socket)
+
+	socket.mu.Lock()
+	delete(socket.topics, filter)
+	socket.mu.Unlock()
+}
+
+// unsubscribeAll removes every subscription of a disconnected socket
+func (h *Hub) unsubscribeAll(socket *Socket) {
+	for _, filter := range socket.Subscriptions() {
+		h.Unsubscribe(socket, filter)
+	}
+}
+
+// Subscribers returns the sockets whose subscriptions match a topic
+func (h *Hub) Subscribers(topic string) []*Socket {
+	matched := h.topics.match(topic)
+	sockets := make([]*Socket, 0, len(matched))
+	for socket := range matched {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+// Publish sends an event on a topic to every socket subscribed to a
+// matching filter, or to every socket for a global topic
+func (h *Hub) Publish(topic string, event string, data interface{}) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	h.BroadcastMessage(Message{
+		T:     h.MessageTypeCode(event),
+		Topic: topic,
+		Data:  data,
+	})
+	return nil
+}
+
+// publish fans a prepared message out to the subscribers of a topic and
+// returns how many it was sent to
+func (h *Hub) publish(topic string, prepared *PreparedMessage) int {
+	var sockets []*Socket
+	for socket := range h.topics.match(topic) {
+		if !socket.IsBanned() {
+			sockets = append(sockets, socket)
+		}
+	}
+	return sendAll(sockets, prepared)
+}
+
+// PublishBinary sends binary data to the subscribers of a topic, or to every
+// socket except the sender for a global topic
+func (h *Hub) PublishBinary(topic string, data []byte, excludeSocket *Socket) {
+	if h.isGlobalTopic(topic) {
+		h.BroadcastBinary(data, excludeSocket)
+		return
+	}
+	h.publish(topic, prepareFileData(data))
+}
+
+// Subscribe subscribes the socket to a topic filter
+func (s *Socket) Subscribe(filter string) error {
+	return s.hub.Subscribe(s, filter)
+}
+
+// Unsubscribe removes the socket's subscription to a topic filter
+func (s *Socket) Unsubscribe(filter string) {
+	s.hub.Unsubscribe(s, filter)
+}
+
+// Subscriptions returns the topic filters the socket is subscribed to
+func (s *Socket) Subscriptions() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	filters := make([]string, 0, len(s.topics))
+	for filter := range s.topics {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// Subscribe subscribes the connection's socket to a topic. Invalid topics
+// are logged and ignored; client connections have no subscriptions.
+//
+// Deprecated: Use Socket.Subscribe, which accepts wildcard filters and
+// reports errors.
+func (c *Connection) Subscribe(topic string) {
+	if c.socket == nil {
+		return
+	}
+	if err := c.socket.Subscribe(topic); err != nil {
+		log.Printf("Subscribe %s to %q: %v", c.socket.ID, topic, err)
+	}
+}
+
+// Unsubscribe removes the connection's socket's subscription to a topic
+//
+// Deprecated: Use Socket.Unsubscribe.
+func (c *Connection) Unsubscribe(topic string) {
+	if c.socket != nil {
+		c.socket.Unsubscribe(topic)
+	}
+}
+
+// IsSubscribed checks if the connection's socket is subscribed to a topic
+// filter
+//
+// Deprecated: Use Socket.Subscriptions, or Hub.Subscribers to match a topic
+// against wildcard filters.
+func (c *Connection) IsSubscribed(topic string) bool {
+	if c.socket == nil {
+		return false
+	}
+	c.socket.mu.RLock()
+	defer c.socket.mu.RUnlock()
+	_, ok := c.socket.topics[topic]
+	return ok
+}
+
+// GetSubscriptions returns a copy of all subscriptions
+//
+// Deprecated: Use Socket.Subscriptions.
+func (c *Connection) GetSubscriptions() map[string]bool {
+	subs := make(map[string]bool)
+	if c.socket == nil {
+		return subs
+	}
+	for _, filter := range c.socket.Subscriptions() {
+		subs[filter] = true
+	}
+	return subs
+}
@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		wantErr bool
+	}{
+		{"news", false},
+		{"orders/+/status", false},
+		{"alerts/#", false},
+		{"#", false},
+		{"+", false},
+		{"+/+", false},
+		{"a//b", false},
+		{"", true},
+		{"a/#/b", true},
+		{"#/a", true},
+		{"a/b#", true},
+		{"a/+b", true},
+		{"sport+", true},
+	}
+	for _, tt := range tests {
+		if err := validateFilter(tt.filter); (err != nil) != tt.wantErr {
+			t.Errorf("validateFilter(%q) error = %v, want error %v", tt.filter, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	tests := []struct {
+		topic   string
+		wantErr bool
+	}{
+		{"news", false},
+		{"orders/42/status", false},
+		{"$SYS/uptime", false},
+		{"", true},
+		{"orders/+", true},
+		{"alerts/#", true},
+	}
+	for _, tt := range tests {
+		if err := validateTopic(tt.topic); (err != nil) != tt.wantErr {
+			t.Errorf("validateTopic(%q) error = %v, want error %v", tt.topic, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"news", "news", true},
+		{"news", "news/sport", false},
+		{"news/sport", "news", false},
+		{"orders/+/status", "orders/42/status", true},
+		{"orders/+/status", "orders/42/items", false},
+		{"orders/+/status", "orders/42/status/old", false},
+		{"orders/+", "orders", false},
+		{"+", "news", true},
+		{"+", "news/sport", false},
+		{"+/+", "a/b", true},
+		{"+/b", "/b", true},
+		{"alerts/#", "alerts/fire/kitchen", true},
+		{"alerts/#", "alerts/fire", true},
+		{"alerts/#", "alerts", true},
+		{"alerts/#", "alert", false},
+		{"#", "anything/at/all", true},
+		{"+/#", "a", true},
+		{"a/+/#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$SYS/+", "$SYS/uptime", true},
+	}
+	for _, tt := range tests {
+		tree := newTopicTree()
+		socket := &Socket{ID: "s"}
+		tree.subscribe(tt.filter, socket)
+		_, got := tree.match(tt.topic)[socket]
+		if got != tt.want {
+			t.Errorf("filter %q on topic %q: matched = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicMatchDeduplicates(t *testing.T) {
+	tree := newTopicTree()
+	socket := &Socket{ID: "s"}
+	for _, filter := range []string{"a/b", "a/+", "a/#", "#"} {
+		tree.subscribe(filter, socket)
+	}
+	if got := len(tree.match("a/b")); got != 1 {
+		t.Fatalf("matched %d times, want 1", got)
+	}
+}
+
+func TestTopicUnsubscribe(t *testing.T) {
+	tree := newTopicTree()
+	a, b := &Socket{ID: "a"}, &Socket{ID: "b"}
+
+	tests := []struct {
+		name        string
+		apply       func()
+		wantFilters []string
+	}{
+		{"subscribe", func() { tree.subscribe("a/b/c", a) }, []string{"a/b/c"}},
+		{"parent filter", func() { tree.subscribe("a/b", b) }, []string{"a/b", "a/b/c"}},
+		{"unknown filter", func() { tree.unsubscribe("x/y", a) }, []string{"a/b", "a/b/c"}},
+		{"other socket", func() { tree.unsubscribe("a/b/c", b) }, []string{"a/b", "a/b/c"}},
+		{"leaf", func() { tree.unsubscribe("a/b/c", a) }, []string{"a/b"}},
+		{"last", func() { tree.unsubscribe("a/b", b) }, nil},
+	}
+	for _, tt := range tests {
+		tt.apply()
+		if got := tree.filters(); !reflect.DeepEqual(got, tt.wantFilters) {
+			t.Errorf("%s: filters = %v, want %v", tt.name, got, tt.wantFilters)
+		}
+	}
+	if len(tree.root.children) != 0 {
+		t.Errorf("empty branches were not pruned: %v", tree.root.children)
+	}
+}
+
+func TestHubSubscribe(t *testing.T) {
+	h := NewHub(nil)
+	socket := testSocket(h)
+
+	tests := []struct {
+		filter  string
+		wantErr error
+	}{
+		{"orders/+/status", nil},
+		{"orders/+/status", nil},
+		{"alerts/#", nil},
+		{"a/#/b", ErrInvalidTopic},
+		{"", ErrInvalidTopic},
+	}
+	for _, tt := range tests {
+		if err := socket.Subscribe(tt.filter); err != tt.wantErr {
+			t.Errorf("Subscribe(%q) error = %v, want %v", tt.filter, err, tt.wantErr)
+		}
+	}
+	if got, want := socket.Subscriptions(), []string{"alerts/#", "orders/+/status"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions = %v, want %v", got, want)
+	}
+	if got := h.Subscribers("orders/7/status"); len(got) != 1 || got[0] != socket {
+		t.Errorf("subscribers = %v", got)
+	}
+	if err := h.Publish("orders/+/status", "message", nil); err != ErrInvalidTopic {
+		t.Errorf("Publish to a wildcard topic: error = %v, want %v", err, ErrInvalidTopic)
+	}
+
+	h.unsubscribeAll(socket)
+	if len(socket.Subscriptions()) != 0 || len(h.Subscribers("alerts/x")) != 0 {
+		t.Error("subscriptions left after unsubscribeAll")
+	}
+}
@@ -0,0 +1,185 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Codes of MsgError replies
+const (
+	ErrorCodeInvalidPayload = 400
+	ErrorCodeUnknownType    = 404
+	ErrorCodeInternal       = 500
+)
+
+// Error is a structured error sent to clients as a MsgError with Code set.
+// Handlers may return one to choose the code; other errors are sent with
+// ErrorCodeInternal.
+type Error struct {
+	Code    int
+	Message string
+	// Fields maps payload fields to what is wrong with them
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	fields := make([]string, 0, len(e.Fields))
+	for field, problem := range e.Fields {
+		fields = append(fields, field+" "+problem)
+	}
+	sort.Strings(fields)
+	return e.Message + ": " + strings.Join(fields, ", ")
+}
+
+// errorMessage builds the MsgError reply for an error. event names the type
+// of the failed message, if known.
+func errorMessage(err error, event string) Message {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: ErrorCodeInternal, Message: err.Error()}
+	}
+	data := map[string]interface{}{"message": e.Message}
+	if event != "" {
+		data["type"] = event
+	}
+	if len(e.Fields) > 0 {
+		data["fields"] = e.Fields
+	}
+	return Message{T: MsgError, Code: e.Code, Data: data}
+}
+
+// Err returns the error carried by a MsgError as *Error, or nil for other
+// messages
+func (m Message) Err() error {
+	if m.T != MsgError {
+		return nil
+	}
+	e := &Error{Code: m.Code}
+	switch data := m.Data.(type) {
+	case map[string]interface{}:
+		e.Message, _ = data["message"].(string)
+		if fields, ok := data["fields"].(map[string]interface{}); ok {
+			e.Fields = make(map[string]string, len(fields))
+			for field, problem := range fields {
+				e.Fields[field], _ = problem.(string)
+			}
+		}
+	case map[string]string:
+		e.Message = data["message"]
+	case string:
+		e.Message = data
+	}
+	if e.Message == "" {
+		e.Message = "request failed"
+	}
+	return e
+}
+
+// SendError sends an error to the socket as a MsgError
+func (s *Socket) SendError(err error) {
+	s.SendMessage(errorMessage(err, ""))
+}
+
+// DecodePayload decodes message data into T, typically a payload struct
+// such as JoinPayload, and checks that fields tagged `validate:"required"`
+// are set. Failures are returned as *Error with ErrorCodeInvalidPayload.
+func DecodePayload[T any](data interface{}) (T, error) {
+	if payload, ok := data.(T); ok {
+		return payload, validatePayload(payload)
+	}
+
+	var payload T
+	if data == nil {
+		return payload, validatePayload(payload)
+	}
+	// Codecs decode objects into maps, which are converted through their
+	// JSON form
+	raw, err := json.Marshal(data)
+	if err == nil {
+		err = json.Unmarshal(raw, &payload)
+	}
+	if err != nil {
+		invalid := &Error{Code: ErrorCodeInvalidPayload, Message: "invalid payload"}
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+			invalid.Fields = map[string]string{typeErr.Field: "must be a " + typeErr.Type.String()}
+		}
+		return payload, invalid
+	}
+	return payload, validatePayload(payload)
+}
+
+// validatePayload checks the required fields of a payload struct
+func validatePayload(payload interface{}) error {
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return &Error{Code: ErrorCodeInvalidPayload, Message: "missing payload"}
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var missing map[string]string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || !hasTagOption(field.Tag.Get("validate"), "required") {
+			continue
+		}
+		if v.Field(i).IsZero() {
+			if missing == nil {
+				missing = make(map[string]string)
+			}
+			missing[jsonFieldName(field)] = "is required"
+		}
+	}
+	if missing != nil {
+		return &Error{Code: ErrorCodeInvalidPayload, Message: "invalid payload", Fields: missing}
+	}
+	return nil
+}
+
+// hasTagOption reports whether a comma-separated tag contains option
+func hasTagOption(tag, option string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if strings.TrimSpace(opt) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldName returns the name of a struct field on the wire
+func jsonFieldName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+// Handle registers a handler for a registered message type whose Data is
+// decoded into T and validated with DecodePayload. A payload that does not
+// decode or validate is answered with a structured MsgError and the handler
+// is not called. Go methods cannot have type parameters, so this is a
+// function taking the hub.
+func Handle[T any](h *Hub, msgType int, handler func(ctx *Context, socket *Socket, payload T) error) {
+	mt, registered := h.LookupMessageType(msgType)
+	if !registered {
+		panic(fmt.Sprintf("websocket: Handle for unregistered message type %d", msgType))
+	}
+	h.OnEvent(mt.Name, func(ctx *Context) error {
+		payload, err := DecodePayload[T](ctx.Message.Data)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, ctx.Socket, payload)
+	})
+}
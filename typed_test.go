@@ -0,0 +1,175 @@
+package ws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type requiredPayload struct {
+	Name    string    `json:"name" validate:"required"`
+	ID      uuid.UUID `json:"id" validate:"required"`
+	Tags    []string  `json:"tags" validate:"required"`
+	Count   int       `json:"count"`
+	Comment string    `json:"comment,omitempty" validate:"omitempty, required"`
+}
+
+func TestDecodePayloadValidation(t *testing.T) {
+	id := uuid.New()
+
+	tests := []struct {
+		name       string
+		data       interface{}
+		wantFields map[string]string
+	}{
+		{"valid", map[string]interface{}{"name": "a", "id": id.String(), "tags": []interface{}{"x"}, "comment": "c"}, nil},
+		{"nil data", nil, map[string]string{"name": "is required", "id": "is required", "tags": "is required", "comment": "is required"}},
+		{"zero uuid", map[string]interface{}{"name": "a", "id": uuid.Nil.String(), "tags": []interface{}{"x"}, "comment": "c"}, map[string]string{"id": "is required"}},
+		{"empty string", map[string]interface{}{"name": "", "id": id.String(), "tags": []interface{}{"x"}, "comment": "c"}, map[string]string{"name": "is required"}},
+		{"typed value", requiredPayload{Name: "a", ID: id, Tags: []string{"x"}, Comment: "c"}, nil},
+		{"typed value missing", requiredPayload{Name: "a"}, map[string]string{"id": "is required", "tags": "is required", "comment": "is required"}},
+		{"wrong type", map[string]interface{}{"name": 5}, map[string]string{"name": "must be a string"}},
+	}
+	for _, tt := range tests {
+		_, err := DecodePayload[requiredPayload](tt.data)
+		if tt.wantFields == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok || e.Code != ErrorCodeInvalidPayload {
+			t.Errorf("%s: error = %#v, want *Error with code %d", tt.name, err, ErrorCodeInvalidPayload)
+			continue
+		}
+		if !reflect.DeepEqual(e.Fields, tt.wantFields) {
+			t.Errorf("%s: fields = %v, want %v", tt.name, e.Fields, tt.wantFields)
+		}
+	}
+}
+
+func TestDecodePayloadPointer(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    interface{}
+		wantErr bool
+	}{
+		{"object", map[string]interface{}{"alias": "bob"}, false},
+		{"missing field", map[string]interface{}{}, true},
+		{"nil pointer", (*AliasPayload)(nil), true},
+	}
+	for _, tt := range tests {
+		if _, err := DecodePayload[*AliasPayload](tt.data); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignalingPayloadCallID(t *testing.T) {
+	id := uuid.New()
+
+	tests := []struct {
+		name        string
+		data        map[string]interface{}
+		wantID      uuid.UUID
+		wantRef     string
+		wantInvalid bool
+	}{
+		{"uuid", map[string]interface{}{"sdp": "v=0", "call_id": id.String()}, id, "", false},
+		{"room ID", map[string]interface{}{"sdp": "v=0", "call_id": "room-42"}, uuid.Nil, "room-42", false},
+		{"missing", map[string]interface{}{"sdp": "v=0"}, uuid.Nil, "", false},
+		{"null", map[string]interface{}{"sdp": "v=0", "call_id": nil}, uuid.Nil, "", false},
+		{"number", map[string]interface{}{"sdp": "v=0", "call_id": 5}, uuid.Nil, "", true},
+	}
+	for _, tt := range tests {
+		sdp, err := DecodePayload[SDPPayload](tt.data)
+		if tt.wantInvalid {
+			if e, ok := err.(*Error); !ok || e.Fields["call_id"] == "" {
+				t.Errorf("%s: error = %v, want an invalid call_id", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if sdp.CallID.UUID != tt.wantID || sdp.CallID.Ref != tt.wantRef {
+			t.Errorf("%s: CallID = %+v, want %v, %q", tt.name, sdp.CallID, tt.wantID, tt.wantRef)
+		}
+
+		// call_id is sent on as received
+		raw, err := json.Marshal(sdp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wire map[string]interface{}
+		json.Unmarshal(raw, &wire)
+		want, _ := tt.data["call_id"].(string)
+		if wire["call_id"] != want || sdp.CallID.String() != want {
+			t.Errorf("%s: encoded call_id = %v, reference %q, want %q", tt.name, wire["call_id"], sdp.CallID, want)
+		}
+	}
+
+	control, err := DecodePayload[ControlPayload](map[string]interface{}{"call_id": "room-1", "track": "video"})
+	if err != nil || control.CallID.Ref != "room-1" || control.Track != "video" {
+		t.Errorf("control payload = %+v, %v", control, err)
+	}
+	dtmf, err := DecodePayload[DTMFPayload](map[string]interface{}{"call_id": id.String(), "tones": "12#"})
+	if err != nil || dtmf.CallID.UUID != id || dtmf.Tones != "12#" {
+		t.Errorf("dtmf payload = %+v, %v", dtmf, err)
+	}
+}
+
+func TestCallRefCodecs(t *testing.T) {
+	id := uuid.New()
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", JSONCodec{}},
+		{"compact", CompactCodec{}},
+		{"msgpack", MsgPackCodec{}},
+		{"cbor", CBORCodec{}},
+	}
+	refs := []struct {
+		name string
+		ref  CallRef
+	}{
+		{"uuid", NewCallRef(id.String())},
+		{"room ID", NewCallRef("room-42")},
+		{"empty", CallRef{}},
+	}
+	for _, c := range codecs {
+		for _, tt := range refs {
+			// Typed payloads are sent as is and arrive as maps
+			data, err := c.codec.Encode(Message{T: MsgDTMF, Data: DTMFPayload{CallID: tt.ref, Tones: "1"}})
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			msg, err := c.codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			dtmf, err := DecodePayload[DTMFPayload](msg.Data)
+			if err != nil {
+				t.Errorf("%s %s: %v", c.name, tt.name, err)
+				continue
+			}
+			if dtmf.CallID != tt.ref || dtmf.Tones != "1" {
+				t.Errorf("%s %s: decoded %+v, want call_id %+v", c.name, tt.name, dtmf, tt.ref)
+			}
+		}
+	}
+}
+
+func TestJoinPayloadDisplayNameOptional(t *testing.T) {
+	if _, err := DecodePayload[JoinPayload](map[string]interface{}{"room": "r"}); err != nil {
+		t.Errorf("join without display_name: %v", err)
+	}
+	if _, err := DecodePayload[JoinPayload](map[string]interface{}{"display_name": "d"}); err == nil {
+		t.Error("join without room accepted")
+	}
+}
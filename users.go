@@ -0,0 +1,139 @@
+package ws
+
+import "log"
+
+// userIDOf returns the user ID of an identity, or an empty string for an
+// anonymous connection
+func userIDOf(identity *Identity) string {
+	if identity == nil {
+		return ""
+	}
+	return identity.UserID
+}
+
+// bindUser moves a socket from the index entry of oldID to that of newID,
+// reporting whether the socket is newly indexed under newID. Sockets that
+// have already left the hub are not indexed again.
+func (h *Hub) bindUser(socket *Socket, oldID, newID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unindexUser(socket, oldID)
+	if newID == "" || h.sockets[socket.ID] != socket {
+		return false
+	}
+	if h.users[newID] == nil {
+		h.users[newID] = make(map[string]*Socket)
+	}
+	h.users[newID][socket.ID] = socket
+	return newID != oldID
+}
+
+// unindexUser removes a socket from the index entry of userID. h.mu must be
+// held for writing.
+func (h *Hub) unindexUser(socket *Socket, userID string) {
+	if sockets, exists := h.users[userID]; exists {
+		delete(sockets, socket.ID)
+		if len(sockets) == 0 {
+			delete(h.users, userID)
+		}
+	}
+}
+
+// GetUserSockets returns every connected socket of a user, one per device or
+// tab
+func (h *Hub) GetUserSockets(userID string) []*Socket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sockets := make([]*Socket, 0, len(h.users[userID]))
+	for _, socket := range h.users[userID] {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+// IsUserOnline reports whether a user has at least one connected socket
+func (h *Hub) IsUserOnline(userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users[userID]) > 0
+}
+
+// EmitToUser sends a message to every socket of a user. While the user has
+// no connected socket the message is stored and delivered on their next
+// connection from any device.
+func (h *Hub) EmitToUser(userID string, event string, data interface{}) {
+	h.EmitMessageToUser(userID, Message{
+		T:    h.MessageTypeCode(event),
+		Data: data,
+	})
+}
+
+// EmitMessageToUser sends a unified Message to every socket of a user,
+// storing it while the user is offline
+func (h *Hub) EmitMessageToUser(userID string, msg Message) {
+	h.emitToUser(userID, msg)
+}
+
+// EmitBinaryToUser sends binary data to every socket of a user, storing it
+// while the user is offline
+func (h *Hub) EmitBinaryToUser(userID string, data []byte) {
+	h.emitBinaryToUser(userID, data)
+}
+
+// EmitMessage sends a unified Message to a recipient, which is either a
+// connected socket ID or a user ID as for EmitMessageToUser
+func (h *Hub) EmitMessage(recipient string, msg Message) {
+	if socket := h.GetSocket(recipient); socket != nil {
+		socket.SendMessage(msg)
+		return
+	}
+	h.emitToUser(recipient, msg)
+}
+
+// emitToUser fans a message out to the sockets of a user or stores it
+func (h *Hub) emitToUser(userID string, msg Message) {
+	if msg.ID == "" {
+		msg.ID = h.NewID()
+	}
+	if sockets := h.userRecipients(userID, msg); len(sockets) > 0 {
+		sendAll(sockets, PrepareMessage(msg))
+	}
+}
+
+// emitBinaryToUser fans binary data out to the sockets of a user or stores
+// it
+func (h *Hub) emitBinaryToUser(userID string, data []byte) {
+	message := Message{
+		T:    MsgFile,
+		Data: data,
+		ID:   h.NewID(),
+	}
+	if sockets := h.userRecipients(userID, message); len(sockets) > 0 {
+		sendAll(sockets, prepareFileData(data))
+	}
+}
+
+// userRecipients returns the sockets of a user to send to, or stores msg if
+// the user is offline. Storing happens under the hub lock so a socket that
+// connects meanwhile finds the message; sending happens after it is
+// released.
+func (h *Hub) userRecipients(userID string, msg Message) []*Socket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.users[userID]) == 0 {
+		if err := h.storage.StoreMessage(userID, msg); err != nil {
+			log.Printf("Error storing message for %s: %v", userID, err)
+		}
+		return nil
+	}
+	sockets := make([]*Socket, 0, len(h.users[userID]))
+	for _, socket := range h.users[userID] {
+		if !socket.IsBanned() {
+			sockets = append(sockets, socket)
+		}
+	}
+	return sockets
+}
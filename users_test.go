@@ -0,0 +1,44 @@
+package ws
+
+import "testing"
+
+func TestInBandAuthDeliversOfflineMessages(t *testing.T) {
+	h := NewHub(nil)
+	h.EmitMessageToUser("alice", Message{T: MsgDirect, Data: map[string]interface{}{"text": "while you were out"}})
+
+	first, second := testSocket(h), testSocket(h)
+	tests := []struct {
+		name     string
+		socket   *Socket
+		identity *Identity
+		want     int
+	}{
+		{"anonymous", first, nil, 0},
+		{"login", first, &Identity{UserID: "alice"}, 1},
+		{"same user again", first, &Identity{UserID: "alice"}, 0},
+		{"second device", second, &Identity{UserID: "alice"}, 0},
+	}
+	for _, tt := range tests {
+		tt.socket.SetIdentity(tt.identity)
+		msgs := sentMessages(t, tt.socket)
+		if len(msgs) != tt.want {
+			t.Errorf("%s: delivered %d messages, want %d: %+v", tt.name, len(msgs), tt.want, msgs)
+			continue
+		}
+		for _, msg := range msgs {
+			data, _ := msg.Data.(map[string]interface{})
+			if msg.T != MsgDirect || data["offline"] != true {
+				t.Errorf("%s: delivered %+v, want an offline MsgDirect", tt.name, msg)
+			}
+		}
+	}
+
+	// Online users get messages directly instead of from storage
+	h.EmitMessageToUser("alice", Message{T: MsgDirect, Data: "hi"})
+	if got := len(sentMessages(t, second)); got != 1 {
+		t.Errorf("online delivery: got %d messages, want 1", got)
+	}
+	if stored, _ := h.Storage().GetMessages("alice"); len(stored) != 0 {
+		t.Errorf("%d messages left in storage", len(stored))
+	}
+}
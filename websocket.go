@@ -2,192 +2,843 @@ package ws
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // WebSocket opcodes
 const (
-	TextMessage   = 1
-	BinaryMessage = 2
-	CloseMessage  = 8
-	PingMessage   = 9
-	PongMessage   = 10
+	ContinuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// defaultStreamFragmentSize is the fragment size used by writeStream when no
+// fragment size has been configured on the connection
+const defaultStreamFragmentSize = 32 * 1024
+
+// Default limits for inbound data, overridable per server
+const (
+	DefaultMaxFrameSize   = 16 << 20
+	DefaultMaxMessageSize = 32 << 20
+)
+
+// maxControlPayload is the largest payload a control frame may carry
+const maxControlPayload = 125
+
+// Protocol violations detected while reading; each carries the close code
+// sent to the peer before the connection is dropped
+var (
+	errUnexpectedContinuation = &CloseError{Code: CloseProtocolError, Reason: "continuation frame without a message in progress"}
+	errExpectedContinuation   = &CloseError{Code: CloseProtocolError, Reason: "new data frame while a fragmented message is in progress"}
+	errFragmentedControl      = &CloseError{Code: CloseProtocolError, Reason: "fragmented control frame"}
+	errControlTooLarge        = &CloseError{Code: CloseProtocolError, Reason: "control frame payload exceeds 125 bytes"}
+	errUnexpectedRSV1         = &CloseError{Code: CloseProtocolError, Reason: "RSV1 set without a negotiated extension"}
+	errReservedBits           = &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	errUnknownOpcode          = &CloseError{Code: CloseProtocolError, Reason: "unknown opcode"}
+	errUnmaskedFrame          = &CloseError{Code: CloseProtocolError, Reason: "client frame is not masked"}
+	errMaskedFrame            = &CloseError{Code: CloseProtocolError, Reason: "server frame is masked"}
+	errInvalidLength          = &CloseError{Code: CloseProtocolError, Reason: "invalid payload length"}
+	errInvalidClosePayload    = &CloseError{Code: CloseProtocolError, Reason: "invalid close frame payload"}
+	errFrameTooLarge          = &CloseError{Code: CloseMessageTooBig, Reason: "frame exceeds maximum size"}
+	errMessageTooLarge        = &CloseError{Code: CloseMessageTooBig, Reason: "message exceeds maximum size"}
+	errInvalidUTF8            = &CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid UTF-8 in text message"}
 )
 
 // Connection represents a WebSocket connection
 type Connection struct {
-	conn          net.Conn
-	reader        *bufio.Reader
-	writer        *bufio.Writer
-	subscriptions map[string]bool
-	mu            sync.Mutex
-	writeChan     chan []byte
-	binaryChan    chan []byte
-	closeChan     chan bool
-}
-
-// readFrame reads a WebSocket frame
-func (c *Connection) readFrame() (opcode byte, payload []byte, err error) {
-	// Read first byte
-	b, err := c.reader.ReadByte()
+	conn        net.Conn
+	reader      *bufio.Reader
+	writer      *bufio.Writer
+	writeMu     sync.Mutex           // serializes frames so fragments of one message are never interleaved
+	writeChan   chan outboundMessage // ordered data messages, text and binary
+	controlChan chan outboundMessage // pong and close frames, written first
+	closeChan   chan bool
+
+	// isClient is set on the client side of a connection: outbound frames
+	// are masked and inbound frames must not be
+	isClient bool
+
+	// Reassembly state for fragmented and compressed inbound messages;
+	// fragments is a pooled buffer, nil between messages
+	fragmentOpcode     byte
+	fragmentCompressed bool
+	fragments          *[]byte
+
+	// controlBuf holds the payload of the last control frame read
+	controlBuf [maxControlPayload]byte
+
+	// stream is the reader returned by NextReader; streaming is set until
+	// the message has been read or discarded
+	stream    messageReader
+	streaming bool
+
+	// Inbound limits; 0 means unlimited
+	maxFrameSize   int64
+	maxMessageSize int64
+
+	// fragmentSize splits outbound messages into continuation frames of at
+	// most this many bytes (0 sends every message as a single frame)
+	fragmentSize int
+
+	// deflate is non-nil when permessage-deflate was negotiated
+	deflate *deflateState
+
+	// Negotiated subprotocol (empty if none) and the codec bound to it
+	subprotocol string
+	codec       Codec
+
+	// Closing handshake state; closeSent is guarded by writeMu
+	closeSent    bool
+	closeTimeout time.Duration
+
+	// Ping scheduling and read/write deadlines
+	keepalive  keepalive
+	deadlineMu sync.Mutex
+
+	// Send queue overflow policy and counters
+	backpressure backpressure
+
+	// socket is the hub socket of a server connection, nil for clients
+	socket *Socket
+
+	// pooled is set in netpoll mode: reader and writer are borrowed from
+	// pools only while in use, and the send queues are drained by an
+	// on-demand goroutine instead of writerLoop, tracked in writers
+	pooled       bool
+	readMu       sync.Mutex
+	writerActive atomic.Bool
+	writers      *sync.WaitGroup
+	pollFD       int
+}
+
+// frameHeader holds the decoded header of a single WebSocket frame
+type frameHeader struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	masked  bool
+	length  int64
+	maskKey [4]byte
+}
+
+// isControl reports whether the opcode is a control frame opcode
+func isControl(opcode byte) bool {
+	return opcode&0x08 != 0
+}
+
+// isKnownControl reports whether the opcode is a defined control opcode;
+// 0xB-0xF are reserved
+func isKnownControl(opcode byte) bool {
+	return opcode == CloseMessage || opcode == PingMessage || opcode == PongMessage
+}
+
+// isData reports whether the opcode is a data or continuation opcode
+func isData(opcode byte) bool {
+	return opcode == ContinuationFrame || opcode == TextMessage || opcode == BinaryMessage
+}
+
+// readFrameHeader reads and validates a frame header, leaving the payload
+// unread so oversized frames are rejected before anything is allocated. The
+// header is decoded in place from the read buffer.
+func (c *Connection) readFrameHeader() (hdr frameHeader, err error) {
+	b, err := c.reader.Peek(2)
 	if err != nil {
-		return 0, nil, err
+		return hdr, err
+	}
+	hdr.fin = (b[0] & 0x80) != 0
+	hdr.rsv1 = (b[0] & 0x40) != 0
+	hdr.opcode = b[0] & 0x0F
+	hdr.masked = (b[1] & 0x80) != 0
+	reserved := b[0]&0x30 != 0
+	payloadLen := int64(b[1] & 0x7F)
+	c.reader.Discard(2)
+	if reserved {
+		return hdr, errReservedBits
+	}
+
+	switch payloadLen {
+	case 126:
+		// Extended payload length (16 bits)
+		b, err := c.reader.Peek(2)
+		if err != nil {
+			return hdr, err
+		}
+		payloadLen = int64(binary.BigEndian.Uint16(b))
+		c.reader.Discard(2)
+	case 127:
+		// Extended payload length (64 bits)
+		b, err := c.reader.Peek(8)
+		if err != nil {
+			return hdr, err
+		}
+		// The most significant bit must be zero (RFC 6455 5.2)
+		if b[0]&0x80 != 0 {
+			return hdr, errInvalidLength
+		}
+		payloadLen = int64(binary.BigEndian.Uint64(b))
+		c.reader.Discard(8)
+	}
+	hdr.length = payloadLen
+
+	// Read masking key if masked
+	if hdr.masked {
+		b, err := c.reader.Peek(4)
+		if err != nil {
+			return hdr, err
+		}
+		copy(hdr.maskKey[:], b)
+		c.reader.Discard(4)
+	}
+
+	if err := c.validateFrameHeader(hdr); err != nil {
+		return hdr, err
+	}
+	return hdr, nil
+}
+
+// validateFrameHeader enforces the framing rules of RFC 6455 section 5
+func (c *Connection) validateFrameHeader(hdr frameHeader) error {
+	if !isKnownControl(hdr.opcode) && !isData(hdr.opcode) {
+		return errUnknownOpcode
+	}
+	if hdr.masked == c.isClient {
+		if c.isClient {
+			return errMaskedFrame
+		}
+		return errUnmaskedFrame
+	}
+	if isControl(hdr.opcode) {
+		if !hdr.fin {
+			return errFragmentedControl
+		}
+		if hdr.length > maxControlPayload {
+			return errControlTooLarge
+		}
+		if hdr.rsv1 {
+			return errUnexpectedRSV1
+		}
+		return nil
+	}
+	if hdr.rsv1 && (c.deflate == nil || hdr.opcode == ContinuationFrame) {
+		return errUnexpectedRSV1
+	}
+	if c.maxFrameSize > 0 && hdr.length > c.maxFrameSize {
+		return errFrameTooLarge
+	}
+	return nil
+}
+
+// readPayload appends the payload described by hdr to dst and unmasks it
+func (c *Connection) readPayload(hdr frameHeader, dst []byte) ([]byte, error) {
+	n := len(dst)
+	dst = slices.Grow(dst, int(hdr.length))[:n+int(hdr.length)]
+	if _, err := io.ReadFull(c.reader, dst[n:]); err != nil {
+		return nil, err
 	}
-	opcode = b & 0x0F
+	if hdr.masked {
+		maskBytes(hdr.maskKey, 0, dst[n:])
+	}
+	return dst, nil
+}
 
-	// Read second byte
-	b, err = c.reader.ReadByte()
+// readControlPayload reads the payload of a control frame into the
+// connection's control buffer; it is only valid until the next read
+func (c *Connection) readControlPayload(hdr frameHeader) ([]byte, error) {
+	data, err := c.readPayload(hdr, c.controlBuf[:0])
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	masked := (b & 0x80) != 0
-	payloadLen := int(b & 0x7F)
+	c.refreshReadDeadline()
+	if hdr.opcode == CloseMessage {
+		if err := validateClosePayload(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
 
-	if payloadLen == 126 {
-		// Read extended payload length (16 bits)
-		lenBytes := make([]byte, 2)
-		_, err = io.ReadFull(c.reader, lenBytes)
+// readMessage reads the next complete message, reassembling fragmented data
+// messages. Control frames may arrive between the fragments of a data message;
+// they are returned to the caller immediately and reassembly resumes on the
+// next call. Control payloads are only valid until the next read. Protocol
+// violations are reported as *CloseError.
+func (c *Connection) readMessage() (opcode byte, payload []byte, err error) {
+	for {
+		hdr, err := c.readFrameHeader()
 		if err != nil {
 			return 0, nil, err
 		}
-		payloadLen = int(lenBytes[0])<<8 | int(lenBytes[1])
-	} else if payloadLen == 127 {
-		// Read extended payload length (64 bits)
-		lenBytes := make([]byte, 8)
-		_, err = io.ReadFull(c.reader, lenBytes)
+
+		switch {
+		case isControl(hdr.opcode):
+			// Control frames may be interleaved with fragments
+			data, err := c.readControlPayload(hdr)
+			if err != nil {
+				return 0, nil, err
+			}
+			return hdr.opcode, data, nil
+		case hdr.opcode == ContinuationFrame:
+			if c.fragments == nil {
+				return 0, nil, errUnexpectedContinuation
+			}
+			if c.maxMessageSize > 0 && int64(len(*c.fragments))+hdr.length > c.maxMessageSize {
+				return 0, nil, errMessageTooLarge
+			}
+		default:
+			if c.fragments != nil {
+				return 0, nil, errExpectedContinuation
+			}
+			if c.maxMessageSize > 0 && hdr.length > c.maxMessageSize {
+				return 0, nil, errMessageTooLarge
+			}
+			if hdr.fin && !hdr.rsv1 {
+				// Unfragmented uncompressed message, the common case: the
+				// payload is read straight into the returned slice
+				data, err := c.readPayload(hdr, nil)
+				if err != nil {
+					return 0, nil, err
+				}
+				c.refreshReadDeadline()
+				return c.finishMessage(hdr.opcode, false, data)
+			}
+			// Compressed and fragmented messages are assembled in a pooled
+			// buffer
+			c.fragmentOpcode = hdr.opcode
+			c.fragmentCompressed = hdr.rsv1
+			c.fragments = getPayloadBuffer()
+		}
+
+		data, err := c.readPayload(hdr, *c.fragments)
 		if err != nil {
 			return 0, nil, err
 		}
-		payloadLen = int(lenBytes[0])<<56 | int(lenBytes[1])<<48 | int(lenBytes[2])<<40 | int(lenBytes[3])<<32 |
-			int(lenBytes[4])<<24 | int(lenBytes[5])<<16 | int(lenBytes[6])<<8 | int(lenBytes[7])
+		*c.fragments = data
+		c.refreshReadDeadline()
+
+		if hdr.fin {
+			opcode, compressed, buf := c.fragmentOpcode, c.fragmentCompressed, c.fragments
+			c.fragmentOpcode, c.fragmentCompressed, c.fragments = ContinuationFrame, false, nil
+			payload := *buf
+			if !compressed {
+				payload = bytes.Clone(payload)
+			}
+			opcode, payload, err := c.finishMessage(opcode, compressed, payload)
+			putPayloadBuffer(buf)
+			return opcode, payload, err
+		}
 	}
+}
 
-	// Read masking key if masked
-	var maskKey []byte
-	if masked {
-		maskKey = make([]byte, 4)
-		_, err = io.ReadFull(c.reader, maskKey)
+// finishMessage inflates a reassembled message if it was compressed and
+// checks that text messages are valid UTF-8
+func (c *Connection) finishMessage(opcode byte, compressed bool, payload []byte) (byte, []byte, error) {
+	if compressed {
+		var err error
+		payload, err = c.deflate.decompress(payload, c.maxMessageSize)
 		if err != nil {
 			return 0, nil, err
 		}
 	}
+	if opcode == TextMessage && !utf8.Valid(payload) {
+		return 0, nil, errInvalidUTF8
+	}
+	return opcode, payload, nil
+}
 
-	// Read payload
-	payload = make([]byte, payloadLen)
-	_, err = io.ReadFull(c.reader, payload)
-	if err != nil {
-		return 0, nil, err
+// putFrameHeader encodes an unmasked frame header into header, which must
+// hold at least 10 bytes, and returns its length
+func putFrameHeader(header []byte, fin, compressed bool, opcode byte, payloadLen int) int {
+	// First byte: FIN + RSV1 + opcode
+	header[0] = opcode
+	if fin {
+		header[0] |= 0x80
+	}
+	if compressed {
+		header[0] |= 0x40
+	}
+
+	// Second byte: payload length
+	if payloadLen <= 125 {
+		header[1] = byte(payloadLen)
+		return 2
+	} else if payloadLen <= 65535 {
+		header[1] = 126
+		header[2] = byte(payloadLen >> 8)
+		header[3] = byte(payloadLen & 0xFF)
+		return 4
+	}
+	header[1] = 127
+	for i := 0; i < 8; i++ {
+		header[2+i] = byte(payloadLen >> ((7 - i) * 8))
 	}
+	return 10
+}
+
+// writeFrame writes a single frame to the buffered writer without flushing.
+// compressed sets RSV1 and must only be used on the first frame of a message.
+// The caller must hold writeMu.
+func (c *Connection) writeFrame(fin, compressed bool, opcode byte, payload []byte) error {
+	var header [14]byte
+	n := putFrameHeader(header[:], fin, compressed, opcode, len(payload))
 
-	// Unmask payload if masked
-	if masked {
-		for i := 0; i < payloadLen; i++ {
-			payload[i] ^= maskKey[i%4]
+	if c.isClient {
+		// Client frames must be masked with a fresh unpredictable key
+		header[1] |= 0x80
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
 		}
+		copy(header[n:], key[:])
+		n += 4
+		if err := c.writeBuffered(header[:n]); err != nil {
+			return err
+		}
+		return c.writeMasked(key, payload)
 	}
 
-	return opcode, payload, nil
+	if err := c.writeBuffered(header[:n]); err != nil {
+		return err
+	}
+	// Payload is written straight from the caller's slice, large payloads
+	// bypass the bufio buffer entirely
+	_, err := c.writer.Write(payload)
+	return err
 }
 
-// writeMessage writes a WebSocket message
-func (c *Connection) writeMessage(opcode byte, payload []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// writeBuffered copies p into the free space of the write buffer, flushing
+// it first when p does not fit. p must not exceed the buffer size.
+func (c *Connection) writeBuffered(p []byte) error {
+	if c.writer.Available() < len(p) {
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := c.writer.Write(append(c.writer.AvailableBuffer(), p...))
+	return err
+}
 
-	payloadLen := len(payload)
-	var frame []byte
+// writeMasked writes payload masked with key. It is masked in place in the
+// free space of the write buffer, so the caller's slice is left untouched
+// and no copy is made.
+func (c *Connection) writeMasked(key [4]byte, payload []byte) error {
+	pos := 0
+	for len(payload) > 0 {
+		if c.writer.Available() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				return err
+			}
+		}
+		buf := c.writer.AvailableBuffer()
+		n := min(len(payload), cap(buf))
+		buf = append(buf, payload[:n]...)
+		pos = maskBytes(key, pos, buf)
+		if _, err := c.writer.Write(buf); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// maskBytes XORs b with key starting at key offset pos and returns the
+// offset to continue from. Long payloads are masked eight bytes at a time.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	if len(b) >= 16 {
+		var k [8]byte
+		for i := range k {
+			k[i] = key[(pos+i)&3]
+		}
+		kw := binary.LittleEndian.Uint64(k[:])
+		n := len(b) &^ 7
+		for i := 0; i < n; i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^kw)
+		}
+		// n is a multiple of the key length, pos is unchanged
+		b = b[n:]
+	}
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
 
-	// First byte: FIN + opcode
-	frame = append(frame, 0x80|opcode)
+// writeMessage writes a WebSocket message, compressing it when
+// permessage-deflate was negotiated and splitting data messages into
+// fragments when a fragment size is configured
+func (c *Connection) writeMessage(opcode byte, payload []byte) error {
+	c.lockWrite()
+	defer c.unlockWrite()
 
-	// Second byte: payload length
-	if payloadLen <= 125 {
-		frame = append(frame, byte(payloadLen))
-	} else if payloadLen <= 65535 {
-		frame = append(frame, 126)
-		frame = append(frame, byte(payloadLen>>8), byte(payloadLen&0xFF))
-	} else {
-		frame = append(frame, 127)
-		for i := 7; i >= 0; i-- {
-			frame = append(frame, byte(payloadLen>>(i*8)))
+	if c.closeSent {
+		return errCloseSent
+	}
+	c.setWriteDeadline()
+
+	compressed := false
+	if !isControl(opcode) && c.deflate.shouldCompress(len(payload)) {
+		deflated, err := c.deflate.compress(payload)
+		if err != nil {
+			return err
 		}
+		payload = deflated
+		compressed = true
 	}
 
-	// Payload
-	frame = append(frame, payload...)
+	if !isControl(opcode) && c.fragmentSize > 0 {
+		for len(payload) > c.fragmentSize {
+			if err := c.writeFrame(false, compressed, opcode, payload[:c.fragmentSize]); err != nil {
+				return err
+			}
+			opcode = ContinuationFrame
+			compressed = false
+			payload = payload[c.fragmentSize:]
+		}
+	}
 
-	_, err := c.writer.Write(frame)
-	if err != nil {
+	if err := c.writeFrame(true, compressed, opcode, payload); err != nil {
 		return err
 	}
 	return c.writer.Flush()
 }
 
-// writerLoop handles async message writing
+// writeStream writes everything read from r as a single fragmented message,
+// so the full payload never has to be held in memory
+func (c *Connection) writeStream(opcode byte, r io.Reader) error {
+	w := c.newMessageWriter(opcode)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// messageWriter streams one message as a sequence of fragments. It holds
+// writeMu from creation until Close so no other frame can be interleaved.
+type messageWriter struct {
+	c          *Connection
+	opcode     byte
+	compressed bool
+	pooled     *[]byte // pool buffer backing buf
+	buf        []byte
+	err        error
+	closed     bool
+
+	// Set when the message is compressed: writes go through the
+	// connection's flate writer into trunc, which feeds the fragments
+	fw    io.Writer
+	trunc *truncWriter
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// newMessageWriter starts a new fragmented message
+func (c *Connection) newMessageWriter(opcode byte) *messageWriter {
+	c.lockWrite()
+	size := c.fragmentSize
+	if size <= 0 {
+		size = defaultStreamFragmentSize
+	}
+	pooled := getPayloadBuffer()
+	*pooled = slices.Grow(*pooled, size)
+	w := &messageWriter{
+		c:      c,
+		opcode: opcode,
+		pooled: pooled,
+		buf:    (*pooled)[:0:size],
+	}
+	if c.closeSent {
+		w.err = errCloseSent
+		return w
+	}
+	c.setWriteDeadline()
+	if c.deflate != nil {
+		// Stream size is unknown up front, so the threshold does not apply
+		w.trunc = &truncWriter{w: writerFunc(w.writeRaw)}
+		fw, err := c.deflate.compressor(w.trunc)
+		if err != nil {
+			w.err = err
+		} else {
+			w.fw = fw
+			w.compressed = true
+		}
+	}
+	return w
+}
+
+// flushFragment sends the buffered bytes as a non-final fragment
+func (w *messageWriter) flushFragment() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.c.setWriteDeadline()
+	w.err = w.c.writeFrame(false, w.compressed && w.opcode != ContinuationFrame, w.opcode, w.buf)
+	w.opcode = ContinuationFrame
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// Write adds p to the message, compressing it first if negotiated
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("websocket: write to closed message writer")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.fw != nil {
+		return w.fw.Write(p)
+	}
+	return w.writeRaw(p)
+}
+
+// writeRaw buffers p, emitting a fragment each time the buffer fills up
+func (w *messageWriter) writeRaw(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushFragment(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends the final fragment and releases the connection for other writers
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	defer w.c.unlockWrite()
+	defer w.release()
+
+	if w.err != nil {
+		return w.err
+	}
+	if w.fw != nil {
+		if w.err = w.c.deflate.fw.Flush(); w.err != nil {
+			return w.err
+		}
+		if w.err = w.trunc.finish(); w.err != nil {
+			return w.err
+		}
+	}
+	if w.err = w.c.writeFrame(true, w.compressed && w.opcode != ContinuationFrame, w.opcode, w.buf); w.err != nil {
+		return w.err
+	}
+	w.err = w.c.writer.Flush()
+	return w.err
+}
+
+// release returns the fragment buffer to the pool
+func (w *messageWriter) release() {
+	putPayloadBuffer(w.pooled)
+	w.buf = nil
+}
+
+// NewClientConnection wraps a connection whose opening handshake has already
+// completed on the client side. Outbound frames are masked as RFC 6455
+// requires of clients. reader may be nil, or the reader used to parse the
+// handshake response so that any frames it buffered are not lost.
+func NewClientConnection(conn net.Conn, reader *bufio.Reader) *Connection {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Connection{
+		conn:           conn,
+		reader:         reader,
+		writer:         bufio.NewWriter(conn),
+		isClient:       true,
+		codec:          JSONCodec{},
+		maxFrameSize:   DefaultMaxFrameSize,
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// ReadMessage reads the next data message. Pings are answered and pongs are
+// recorded along the way. A close frame from the peer is echoed and returned
+// as *CloseError, as are protocol violations.
+func (c *Connection) ReadMessage() (messageType int, payload []byte, err error) {
+	if err := c.discardStream(); err != nil {
+		return 0, nil, err
+	}
+	for {
+		opcode, payload, err := c.readMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !isControl(opcode) {
+			return int(opcode), payload, nil
+		}
+		if err := c.handleControl(opcode, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// handleControl answers pings, records pongs and echoes close frames. A
+// close frame is returned as *CloseError.
+func (c *Connection) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case PingMessage:
+		c.writeControlAsync(PongMessage, payload)
+	case PongMessage:
+		c.handlePong(payload)
+	case CloseMessage:
+		return c.handleCloseFrame(payload)
+	}
+	return nil
+}
+
+// WriteMessage writes a complete message synchronously
+func (c *Connection) WriteMessage(messageType int, payload []byte) error {
+	return c.writeMessage(byte(messageType), payload)
+}
+
+// WriteClose starts the closing handshake with the given status code
+func (c *Connection) WriteClose(code int, reason string) error {
+	return c.closeWithTimeout(code, reason)
+}
+
+// Close closes the underlying network connection immediately
+func (c *Connection) Close() error {
+	return c.conn.Close()
+}
+
+// Control queue size; control frames are small and drained first
+const controlQueueSize = 8
+
+// writerLoop writes queued messages in order and sends keepalive pings.
+// Control frames queued with writeControlAsync jump ahead of data messages.
 func (c *Connection) writerLoop() {
+	var pingC <-chan time.Time
+	if c.keepalive.pingInterval > 0 {
+		ticker := time.NewTicker(c.keepalive.pingInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+
 	for {
 		select {
-		case data := <-c.writeChan:
-			if len(data) == 0 {
-				return // Empty message signals close
+		case msg := <-c.controlChan:
+			c.writeOutbound(msg)
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-c.controlChan:
+			c.writeOutbound(msg)
+		case msg := <-c.writeChan:
+			if msg.messageType == 0 && msg.prepared == nil {
+				return // Zero message signals close
 			}
-			c.writeMessage(TextMessage, data)
-		case binary := <-c.binaryChan:
-			c.writeMessage(BinaryMessage, binary)
+			c.writeOutbound(msg)
+			c.clearSlow()
+		case <-pingC:
+			c.sendPing()
 		case <-c.closeChan:
 			return
 		}
 	}
 }
 
-// writeAsync writes a message asynchronously
-func (c *Connection) writeAsync(data []byte) {
-	select {
-	case c.writeChan <- data:
+// outboundMessage is an entry in the async write queues: either a payload to
+// frame or a prepared message
+type outboundMessage struct {
+	messageType int
+	data        []byte
+	prepared    *PreparedMessage
+}
+
+// writeOutbound writes one queued message
+func (c *Connection) writeOutbound(msg outboundMessage) {
+	switch {
+	case msg.prepared != nil:
+		c.writePrepared(msg.prepared)
+	case msg.messageType == CloseMessage:
+		code, reason := parseClosePayload(msg.data)
+		c.closeWithTimeout(code, reason)
+	case msg.messageType == PingMessage:
+		c.sendPing()
 	default:
-		// Channel full, drop message to prevent blocking
+		c.writeMessage(byte(msg.messageType), msg.data)
 	}
 }
 
-// writeBinaryAsync writes binary data asynchronously
-func (c *Connection) writeBinaryAsync(data []byte) {
+// writeControlAsync queues a ping, pong or close frame ahead of pending data
+// messages. Without a running writer, e.g. on client connections, the frame
+// is written synchronously.
+func (c *Connection) writeControlAsync(opcode byte, payload []byte) {
+	if c.controlChan == nil {
+		if opcode == CloseMessage {
+			code, reason := parseClosePayload(payload)
+			c.closeWithTimeout(code, reason)
+		} else {
+			c.writeMessage(opcode, payload)
+		}
+		return
+	}
+	// The payload may point into the connection's control buffer
 	select {
-	case c.binaryChan <- data:
+	case c.controlChan <- outboundMessage{messageType: int(opcode), data: bytes.Clone(payload)}:
+		c.wakeWriter()
 	default:
-		// Channel full, drop message to prevent blocking
+		// A backlog of control frames means the peer is not reading; a
+		// dropped pong is answered by the next one
 	}
 }
 
-// Subscribe adds a topic to the connection's subscriptions
-func (c *Connection) Subscribe(topic string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.subscriptions[topic] = true
+// writeAsync writes a text message asynchronously
+func (c *Connection) writeAsync(data []byte) {
+	c.enqueue(outboundMessage{messageType: TextMessage, data: data})
 }
 
-// Unsubscribe removes a topic from the connection's subscriptions
-func (c *Connection) Unsubscribe(topic string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.subscriptions, topic)
+// writePreparedAsync writes a prepared message asynchronously
+func (c *Connection) writePreparedAsync(pm *PreparedMessage) {
+	c.enqueue(outboundMessage{messageType: pm.messageType, prepared: pm})
 }
 
-// IsSubscribed checks if the connection is subscribed to a topic
-func (c *Connection) IsSubscribed(topic string) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.subscriptions[topic]
+// messageCodec returns the codec bound to the connection, falling back to
+// the format-guessing legacy codec
+func (c *Connection) messageCodec() Codec {
+	if c.codec == nil {
+		return legacyCodec{}
+	}
+	return c.codec
 }
 
-// GetSubscriptions returns a copy of all subscriptions
-func (c *Connection) GetSubscriptions() map[string]bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	subs := make(map[string]bool)
-	for topic, subscribed := range c.subscriptions {
-		subs[topic] = subscribed
-	}
-	return subs
+// writeEncodedAsync queues an encoded message in the frame type of its codec
+func (c *Connection) writeEncodedAsync(codec Codec, data []byte) {
+	c.enqueue(outboundMessage{messageType: codec.MessageType(), data: data})
+}
+
+// writeBinaryAsync writes binary data asynchronously. It shares the queue
+// with text messages, so a file's metadata message always precedes its data.
+func (c *Connection) writeBinaryAsync(data []byte) {
+	c.enqueue(outboundMessage{messageType: BinaryMessage, data: data})
 }
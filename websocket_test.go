@@ -0,0 +1,139 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// rawFrame encodes a single frame as a client would send it: masked with a
+// fixed key unless unmasked is set. flags holds the FIN and RSV bits.
+func rawFrame(flags, opcode byte, payload []byte, unmasked bool) []byte {
+	frame := []byte{flags | opcode}
+	lenByte := byte(0)
+	if !unmasked {
+		lenByte = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, lenByte|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, lenByte|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, lenByte|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if unmasked {
+		return append(frame, payload...)
+	}
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, key[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+)
+
+// readRaw reads one message from raw client frames on a server connection
+func readRaw(c *Connection, frames ...[]byte) (byte, []byte, error) {
+	c.reader = bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil)))
+	return c.readMessage()
+}
+
+func TestReadFrameValidation(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 126)
+	tests := []struct {
+		name      string
+		frames    [][]byte
+		client    bool
+		maxFrame  int64
+		maxMsg    int64
+		wantCode  int
+		wantOp    byte
+		wantBytes string
+	}{
+		{name: "text", frames: [][]byte{rawFrame(finBit, TextMessage, []byte("hello"), false)}, wantOp: TextMessage, wantBytes: "hello"},
+		{name: "fragmented text", frames: [][]byte{
+			rawFrame(0, TextMessage, []byte("hel"), false),
+			rawFrame(finBit, ContinuationFrame, []byte("lo"), false),
+		}, wantOp: TextMessage, wantBytes: "hello"},
+		{name: "ping between fragments", frames: [][]byte{
+			rawFrame(0, TextMessage, []byte("hel"), false),
+			rawFrame(finBit, PingMessage, []byte("p"), false),
+		}, wantOp: PingMessage, wantBytes: "p"},
+		{name: "reserved opcode 0x3", frames: [][]byte{rawFrame(finBit, 0x3, nil, false)}, wantCode: CloseProtocolError},
+		{name: "reserved control opcode 0xB", frames: [][]byte{rawFrame(finBit, 0xB, nil, false)}, wantCode: CloseProtocolError},
+		{name: "RSV2 set", frames: [][]byte{rawFrame(finBit|rsv2Bit, TextMessage, []byte("x"), false)}, wantCode: CloseProtocolError},
+		{name: "RSV1 without deflate", frames: [][]byte{rawFrame(finBit|rsv1Bit, TextMessage, []byte("x"), false)}, wantCode: CloseProtocolError},
+		{name: "fragmented ping", frames: [][]byte{rawFrame(0, PingMessage, []byte("p"), false)}, wantCode: CloseProtocolError},
+		{name: "oversized ping", frames: [][]byte{rawFrame(finBit, PingMessage, long, false)}, wantCode: CloseProtocolError},
+		{name: "unmasked client frame", frames: [][]byte{rawFrame(finBit, TextMessage, []byte("x"), true)}, wantCode: CloseProtocolError},
+		{name: "masked server frame", client: true, frames: [][]byte{rawFrame(finBit, TextMessage, []byte("x"), false)}, wantCode: CloseProtocolError},
+		{name: "continuation without start", frames: [][]byte{rawFrame(finBit, ContinuationFrame, []byte("x"), false)}, wantCode: CloseProtocolError},
+		{name: "new message during fragments", frames: [][]byte{
+			rawFrame(0, TextMessage, []byte("a"), false),
+			rawFrame(finBit, BinaryMessage, []byte("b"), false),
+		}, wantCode: CloseProtocolError},
+		{name: "invalid UTF-8", frames: [][]byte{rawFrame(finBit, TextMessage, []byte{0xff, 0xfe}, false)}, wantCode: CloseInvalidFramePayloadData},
+		{name: "UTF-8 split across fragments", frames: [][]byte{
+			rawFrame(0, TextMessage, []byte{'a', 0xe2, 0x82}, false),
+			rawFrame(finBit, ContinuationFrame, []byte{0xac}, false),
+		}, wantOp: TextMessage, wantBytes: "a€"},
+		{name: "truncated UTF-8 at end", frames: [][]byte{
+			rawFrame(0, TextMessage, []byte{'a', 0xe2}, false),
+			rawFrame(finBit, ContinuationFrame, []byte{0x82}, false),
+		}, wantCode: CloseInvalidFramePayloadData},
+		{name: "invalid UTF-8 close reason", frames: [][]byte{rawFrame(finBit, CloseMessage, []byte{0x03, 0xe8, 0xff}, false)}, wantCode: CloseInvalidFramePayloadData},
+		{name: "invalid close code", frames: [][]byte{rawFrame(finBit, CloseMessage, []byte{0x03, 0xee}, false)}, wantCode: CloseProtocolError},
+		{name: "frame over limit", maxFrame: 4, frames: [][]byte{rawFrame(finBit, BinaryMessage, []byte("12345"), false)}, wantCode: CloseMessageTooBig},
+		{name: "message over limit", maxMsg: 4, frames: [][]byte{
+			rawFrame(0, BinaryMessage, []byte("123"), false),
+			rawFrame(finBit, ContinuationFrame, []byte("45"), false),
+		}, wantCode: CloseMessageTooBig},
+		{name: "64-bit length with MSB set", frames: [][]byte{{finBit | BinaryMessage, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 1}}, wantCode: CloseProtocolError},
+	}
+	for _, tt := range tests {
+		c := &Connection{isClient: tt.client, maxFrameSize: tt.maxFrame, maxMessageSize: tt.maxMsg}
+		op, payload, err := readRaw(c, tt.frames...)
+		if tt.wantCode != 0 {
+			closeErr, ok := err.(*CloseError)
+			if !ok || closeErr.Code != tt.wantCode {
+				t.Errorf("%s: err = %v, want close code %d", tt.name, err, tt.wantCode)
+			}
+			continue
+		}
+		if err != nil || op != tt.wantOp || string(payload) != tt.wantBytes {
+			t.Errorf("%s: got op %d %q, err %v; want op %d %q", tt.name, op, payload, err, tt.wantOp, tt.wantBytes)
+		}
+	}
+}
+
+func TestWriteReadFragmented(t *testing.T) {
+	payload := bytes.Repeat([]byte("abcdefg"), 100)
+	tests := []struct {
+		name         string
+		fragmentSize int
+		opcode       byte
+	}{
+		{"unfragmented text", 0, TextMessage},
+		{"fragmented text", 10, TextMessage},
+		{"fragmented binary", 1, BinaryMessage},
+	}
+	for _, tt := range tests {
+		client, server := connPair()
+		client.fragmentSize = tt.fragmentSize
+		go client.writeMessage(tt.opcode, payload)
+		op, got, err := server.readMessage()
+		if err != nil || op != tt.opcode || !bytes.Equal(got, payload) {
+			t.Errorf("%s: op %d, %d bytes, err %v", tt.name, op, len(got), err)
+		}
+	}
+}